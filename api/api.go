@@ -0,0 +1,188 @@
+package api
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Error is returned by handlers to answer with a JSON error body:
+//
+//	{"error": {"code": "not_found", "message": "Session not found"}}
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+type ErrorBody struct {
+	Error Error `json:"error"`
+}
+
+func BadRequest(message string) *Error {
+	return &Error{Status: 400, Code: "bad_request", Message: message}
+}
+
+func NotFound(message string) *Error {
+	return &Error{Status: 404, Code: "not_found", Message: message}
+}
+
+func Conflict(message string) *Error {
+	return &Error{Status: 409, Code: "conflict", Message: message}
+}
+
+func Internal(message string) *Error {
+	return &Error{Status: 500, Code: "internal", Message: message}
+}
+
+// WriteError sends err as an error body, anything that isn't an *Error is an
+// internal error
+func WriteError(c *fiber.Ctx, err error) error {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		apiErr = Internal(err.Error())
+	}
+	return c.Status(apiErr.Status).JSON(ErrorBody{Error: *apiErr})
+}
+
+// NoBody is used as the request type of routes without parameters or body,
+// and as the response type of routes answering 204 No Content
+type NoBody struct{}
+
+var noBodyType = reflect.TypeOf(NoBody{})
+
+type Route struct {
+	Method      string
+	Path        string
+	Summary     string
+	Request     reflect.Type
+	Response    reflect.Type
+	ContentType string
+}
+
+// Router registers handlers on a fiber router and keeps the route table the
+// OpenAPI document is generated from
+type Router struct {
+	Title   string
+	Version string
+	Prefix  string
+	group   fiber.Router
+	routes  []Route
+}
+
+func NewRouter(app *fiber.App, prefix, title, version string) *Router {
+	r := &Router{
+		Title:   title,
+		Version: version,
+		Prefix:  prefix,
+		group:   app.Group(prefix),
+	}
+	r.group.Get("/openapi.json", func(c *fiber.Ctx) error {
+		return c.JSON(r.OpenAPI())
+	})
+	return r
+}
+
+func (r *Router) Routes() []Route {
+	return r.routes
+}
+
+// Handle registers a JSON route. Req is filled from the path parameters
+// (`params` tags), the query string (`query` tags) and the JSON body, and the
+// returned Resp is sent as JSON. The route is documented from Req and Resp.
+func Handle[Req, Resp any](r *Router, method, path, summary string, fn func(c *fiber.Ctx, req *Req) (Resp, error)) {
+
+	reqType := reflect.TypeFor[Req]()
+	respType := reflect.TypeFor[Resp]()
+	_, hasParams := taggedFields(reqType, "params")
+	_, hasQuery := taggedFields(reqType, "query")
+	_, hasBody := bodyFields(reqType)
+
+	r.routes = append(r.routes, Route{
+		Method:      method,
+		Path:        path,
+		Summary:     summary,
+		Request:     reqType,
+		Response:    respType,
+		ContentType: fiber.MIMEApplicationJSON,
+	})
+
+	r.group.Add(method, path, func(c *fiber.Ctx) error {
+		var req Req
+		if hasParams {
+			if err := c.ParamsParser(&req); err != nil {
+				return WriteError(c, BadRequest("Invalid path parameter"))
+			}
+		}
+		if hasQuery {
+			if err := c.QueryParser(&req); err != nil {
+				return WriteError(c, BadRequest("Invalid query parameter"))
+			}
+		}
+		// An empty body leaves the fields at their zero values
+		if hasBody && len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return WriteError(c, BadRequest("Invalid body"))
+			}
+		}
+
+		resp, err := fn(c, &req)
+		if err != nil {
+			return WriteError(c, err)
+		}
+		if respType == noBodyType {
+			return c.SendStatus(204)
+		}
+		return c.JSON(resp)
+	})
+}
+
+// Raw registers a route that writes its own response, like event streams.
+// It's documented with only its content type.
+func (r *Router) Raw(method, path, summary, contentType string, handler fiber.Handler) {
+	r.routes = append(r.routes, Route{
+		Method:      method,
+		Path:        path,
+		Summary:     summary,
+		Request:     noBodyType,
+		ContentType: contentType,
+	})
+	r.group.Add(method, path, handler)
+}
+
+// taggedFields returns the names given by tag on the fields of t
+func taggedFields(t reflect.Type, tag string) ([]reflect.StructField, bool) {
+	var fields []reflect.StructField
+	if t.Kind() != reflect.Struct {
+		return nil, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name, _, _ := strings.Cut(f.Tag.Get(tag), ","); name != "" && f.IsExported() {
+			fields = append(fields, f)
+		}
+	}
+	return fields, len(fields) > 0
+}
+
+// bodyFields returns the fields of t read from the JSON body
+func bodyFields(t reflect.Type) ([]reflect.StructField, bool) {
+	var fields []reflect.StructField
+	if t.Kind() != reflect.Struct {
+		return nil, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Tag.Get("params") != "" || f.Tag.Get("query") != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields, len(fields) > 0
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"encoding/json"
+	"polyserver/config"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//
+// OPENAPI
+//
+
+var pathParam = regexp.MustCompile(`:(\w+)`)
+
+// OpenAPI builds an OpenAPI 3.0 document from the route table
+func (r *Router) OpenAPI() map[string]any {
+
+	g := &schemaGenerator{components: map[string]any{}}
+
+	paths := map[string]map[string]any{}
+	for _, route := range r.routes {
+		path := pathParam.ReplaceAllString(r.Prefix+route.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(route.Method)] = g.operation(route)
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   r.Title,
+			"version": r.Version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.components,
+		},
+	}
+}
+
+func (g *schemaGenerator) operation(route Route) map[string]any {
+
+	op := map[string]any{
+		"summary": route.Summary,
+	}
+
+	var params []map[string]any
+	for _, in := range []string{"params", "query"} {
+		fields, _ := taggedFields(route.Request, in)
+		for _, f := range fields {
+			name, _, _ := strings.Cut(f.Tag.Get(in), ",")
+			location := "query"
+			if in == "params" {
+				location = "path"
+			}
+			params = append(params, map[string]any{
+				"name":     name,
+				"in":       location,
+				"required": location == "path",
+				"schema":   g.schema(f.Type),
+			})
+		}
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if fields, ok := bodyFields(route.Request); ok {
+		schema := g.objectSchema(fields)
+		_, required := schema["required"]
+		op["requestBody"] = map[string]any{
+			"required": required,
+			"content": map[string]any{
+				"application/json": map[string]any{
+					"schema": schema,
+				},
+			},
+		}
+	}
+
+	responses := map[string]any{}
+	switch {
+	case route.Response == nil:
+		responses["200"] = map[string]any{
+			"description": "OK",
+			"content": map[string]any{
+				route.ContentType: map[string]any{},
+			},
+		}
+	case route.Response == noBodyType:
+		responses["204"] = map[string]any{"description": "No Content"}
+	default:
+		responses["200"] = map[string]any{
+			"description": "OK",
+			"content": map[string]any{
+				"application/json": map[string]any{
+					"schema": g.schema(route.Response),
+				},
+			},
+		}
+	}
+	responses["default"] = map[string]any{
+		"description": "Error",
+		"content": map[string]any{
+			"application/json": map[string]any{
+				"schema": g.schema(reflect.TypeFor[ErrorBody]()),
+			},
+		},
+	}
+	op["responses"] = responses
+
+	return op
+}
+
+//
+// SCHEMAS
+//
+
+type schemaGenerator struct {
+	components map[string]any
+}
+
+var (
+	timeType     = reflect.TypeFor[time.Time]()
+	durationType = reflect.TypeFor[time.Duration]()
+	// Durations in the config format, e.g. "100ms"
+	configDurationType = reflect.TypeFor[config.Duration]()
+	marshalerType      = reflect.TypeFor[json.Marshaler]()
+)
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]any{"type": "integer", "description": "nanoseconds"}
+	case configDurationType:
+		return map[string]any{"type": "string", "example": "100ms"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := g.schema(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]any{"allOf": []any{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		// Types with their own encoding can't be described from their fields
+		if t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType) {
+			return map[string]any{}
+		}
+		if t.Name() == "" {
+			return g.objectSchema(visibleFields(t))
+		}
+		name := t.Name()
+		if _, ok := g.components[name]; !ok {
+			// Placeholder first so recursive types terminate
+			g.components[name] = map[string]any{}
+			g.components[name] = g.objectSchema(visibleFields(t))
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+
+	// interfaces and anything else can hold any value
+	return map[string]any{}
+}
+
+// objectSchema describes fields as they're encoded by encoding/json
+func (g *schemaGenerator) objectSchema(fields []reflect.StructField) map[string]any {
+
+	properties := map[string]any{}
+	required := []string{}
+	for _, f := range fields {
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := g.schema(f.Type)
+		if strings.Contains(opts, "string") {
+			s = map[string]any{"type": "string"}
+		}
+		properties[name] = s
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+
+	s := map[string]any{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// visibleFields flattens embedded structs the way encoding/json does
+func visibleFields(t reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
+	for _, f := range reflect.VisibleFields(t) {
+		if f.Anonymous && embedded(f) {
+			continue
+		}
+		if !f.IsExported() || !promoted(t, f) {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// embedded reports whether f's fields are promoted into its parent's object
+func embedded(f reflect.StructField) bool {
+	t := f.Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return t.Kind() == reflect.Struct && name == ""
+}
+
+// promoted reports whether every struct f is nested in gets flattened
+func promoted(t reflect.Type, f reflect.StructField) bool {
+	for i := 1; i < len(f.Index); i++ {
+		if !embedded(t.FieldByIndex(f.Index[:i])) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"polyserver/api"
+	"polyserver/config"
+	"polyserver/game"
+	gametrack "polyserver/game/track"
+	"polyserver/logging"
+	"polyserver/metrics"
+	"polyserver/signaling"
+	"polyserver/tournament"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+//
+// API V1 TYPES
+//
+
+type SessionInfo struct {
+	ID               uint32        `json:"id"`
+	GameMode         game.GameMode `json:"gamemode"`
+	GameModeName     string        `json:"gamemodeName"`
+	SwitchingSession bool          `json:"switchingSession"`
+	MaxPlayers       int           `json:"maxPlayers"`
+	Track            string        `json:"track"`
+	TrackID          string        `json:"trackId"`
+	// Tick rates the session was set up with, 0 for the configured defaults
+	CarUpdateInterval config.Duration `json:"carUpdateInterval"`
+	PingInterval      config.Duration `json:"pingInterval"`
+	// Intervals in use, the car update one adapted to the load
+	CurrentCarUpdateInterval config.Duration `json:"currentCarUpdateInterval"`
+	CurrentPingInterval      config.Duration `json:"currentPingInterval"`
+}
+
+type StatusResponse struct {
+	Invite    string                     `json:"invite"`
+	Players   int                        `json:"players"`
+	Session   SessionInfo                `json:"session"`
+	Signaling signaling.ConnectionStatus `json:"signaling"`
+}
+
+type InviteResponse struct {
+	Invite string `json:"invite"`
+}
+
+type TrackInfo struct {
+	Name   string `json:"name"`
+	Author string `json:"author"`
+	ID     string `json:"id"`
+}
+
+type TracksResponse struct {
+	Tracks []TrackInfo `json:"tracks"`
+}
+
+type PlayerInfo struct {
+	ID          uint32  `json:"id"`
+	Nickname    string  `json:"nickname"`
+	CountryCode *string `json:"countryCode"`
+	// Best time of the current session in frames, nil until they finish
+	Frames       *uint32 `json:"frames"`
+	Ping         int     `json:"ping"`
+	ResetCounter uint32  `json:"resetCounter"`
+	// ID of the car the player watches, 0 for their own
+	Spectating uint32 `json:"spectating"`
+}
+
+type PlayersResponse struct {
+	Players []PlayerInfo `json:"players"`
+}
+
+type ICEResponse struct {
+	Players []game.PlayerICE `json:"players"`
+}
+
+type StandingsResponse struct {
+	SessionID uint32          `json:"sessionId"`
+	Standings []game.Standing `json:"standings"`
+}
+
+type SessionsResponse struct {
+	Sessions []*game.SessionSummary `json:"sessions"`
+}
+
+type SetSessionRequest struct {
+	GameMode   game.GameMode `json:"gamemode"`
+	Track      string        `json:"track"`
+	MaxPlayers int           `json:"maxPlayers"`
+	// Omitted or 0 uses the configured intervals
+	CarUpdateInterval config.Duration `json:"carUpdateInterval"`
+	PingInterval      config.Duration `json:"pingInterval"`
+}
+
+type InvitesResponse struct {
+	Invites []signaling.Invite `json:"invites"`
+}
+
+type NewInviteRequest struct {
+	// Empty replaces the main invite
+	Label string `json:"label"`
+}
+
+type InviteCodeRequest struct {
+	// Code or label of the invite
+	Code string `params:"code" json:"-"`
+}
+
+type PlayerRequest struct {
+	ID uint32 `params:"id" json:"-"`
+}
+
+type SpectateRequest struct {
+	ID     uint32 `params:"id" json:"-"`
+	Target uint32 `json:"target"`
+}
+
+type SessionRequest struct {
+	ID uint32 `params:"id" json:"-"`
+}
+
+type CreateTournamentRequest struct {
+	Name     string                   `json:"name"`
+	HeatSize int                      `json:"heatSize"`
+	Rounds   []tournament.RoundConfig `json:"rounds"`
+	Players  []string                 `json:"players"`
+}
+
+type HeatRequest struct {
+	Index int `params:"index" json:"-"`
+}
+
+type DrainRequest struct {
+	Notice string `json:"notice,omitempty"`
+}
+
+type LogLevelRequest struct {
+	Subsystem string `json:"subsystem"`
+	Level     string `json:"level"`
+}
+
+//
+// API V1 ROUTES
+//
+
+type apiServer struct {
+	signaling   *signaling.WebRTCServer
+	game        *game.GameServer
+	tracks      map[string]*gametrack.Track
+	trackNames  []string
+	archive     *game.SessionArchive
+	tournaments *tournament.Manager
+	drain       func(notice string)
+}
+
+func (s *apiServer) sessionInfo() SessionInfo {
+	session := s.game.Session()
+	info := SessionInfo{
+		ID:               session.SessionID,
+		GameMode:         session.GameMode,
+		GameModeName:     session.GameMode.String(),
+		SwitchingSession: session.SwitchingSession,
+		MaxPlayers:       session.MaxPlayers,
+
+		CarUpdateInterval: session.CarUpdateInterval,
+		PingInterval:      session.PingInterval,
+	}
+	carUpdate, ping := s.game.TickRates()
+	info.CurrentCarUpdateInterval = config.Duration(carUpdate)
+	info.CurrentPingInterval = config.Duration(ping)
+	for name, t := range s.tracks {
+		if t == session.CurrentTrack {
+			info.Track = name
+			break
+		}
+	}
+	if session.CurrentTrack != nil {
+		info.TrackID, _ = session.CurrentTrack.GetTrackID()
+	}
+	return info
+}
+
+// validateSession checks a session set through the control API, old or new
+func validateSession(session game.GameSession) error {
+	if session.GameMode != game.Casual && session.GameMode != game.Competitive {
+		return errors.New("unknown gamemode")
+	}
+	if session.MaxPlayers < 1 || session.MaxPlayers > 255 {
+		return errors.New("maxPlayers must be between 1 and 255")
+	}
+	if session.CarUpdateInterval != 0 && session.CarUpdateInterval < config.Duration(10*time.Millisecond) {
+		return errors.New("carUpdateInterval must be at least 10ms")
+	}
+	if session.PingInterval != 0 && session.PingInterval < config.Duration(100*time.Millisecond) {
+		return errors.New("pingInterval must be at least 100ms")
+	}
+	return nil
+}
+
+// requestInvite asks for an invite and waits for the signaling server to
+// hand it out
+func requestInvite(server *signaling.WebRTCServer, label string) (signaling.Invite, error) {
+	done, err := server.RequestInvite(label)
+	if err != nil {
+		return signaling.Invite{}, err
+	}
+	select {
+	case invite := <-done:
+		return invite, nil
+	case <-time.After(5 * time.Second):
+		return signaling.Invite{}, errors.New("signaling server didn't answer")
+	}
+}
+
+// registerAPIv1 mounts the versioned control API on /api/v1, its OpenAPI
+// document is served on /api/v1/openapi.json
+func registerAPIv1(app *fiber.App, s *apiServer) {
+
+	r := api.NewRouter(app, "/api/v1", "PolyServer control API", "1.0.0")
+
+	api.Handle(r, "GET", "/status", "Server and session status",
+		func(c *fiber.Ctx, req *api.NoBody) (StatusResponse, error) {
+			return StatusResponse{
+				Invite:    s.signaling.CurrentInvite(),
+				Players:   s.game.PlayerCount(),
+				Session:   s.sessionInfo(),
+				Signaling: s.signaling.Status(),
+			}, nil
+		})
+
+	api.Handle(r, "POST", "/invite", "Create a new invite code",
+		func(c *fiber.Ctx, req *api.NoBody) (InviteResponse, error) {
+			invite, err := requestInvite(s.signaling, "")
+			if err != nil {
+				return InviteResponse{}, api.Internal(err.Error())
+			}
+			return InviteResponse{Invite: invite.Code}, nil
+		})
+
+	api.Handle(r, "GET", "/invites", "Invites with their expiry and use count",
+		func(c *fiber.Ctx, req *api.NoBody) (InvitesResponse, error) {
+			return InvitesResponse{Invites: s.signaling.Invites()}, nil
+		})
+
+	api.Handle(r, "POST", "/invites", "Create an invite, replacing the one with the same label",
+		func(c *fiber.Ctx, req *NewInviteRequest) (signaling.Invite, error) {
+			invite, err := requestInvite(s.signaling, req.Label)
+			if err != nil {
+				return signaling.Invite{}, api.Internal(err.Error())
+			}
+			return invite, nil
+		})
+
+	api.Handle(r, "DELETE", "/invites/:code", "Revoke an invite",
+		func(c *fiber.Ctx, req *InviteCodeRequest) (signaling.RevokedInvite, error) {
+			invite, err := s.signaling.RevokeInvite(req.Code)
+			if errors.Is(err, signaling.ErrInviteNotFound) {
+				return signaling.RevokedInvite{}, api.NotFound("Invite not found")
+			}
+			return invite, err
+		})
+
+	api.Handle(r, "GET", "/signaling", "Signaling connection state",
+		func(c *fiber.Ctx, req *api.NoBody) (signaling.ConnectionStatus, error) {
+			return s.signaling.Status(), nil
+		})
+
+	api.Handle(r, "POST", "/signaling/retry", "Reconnect to the signaling server after giving up",
+		func(c *fiber.Ctx, req *api.NoBody) (signaling.ConnectionStatus, error) {
+			if err := s.signaling.Retry(); err != nil {
+				return signaling.ConnectionStatus{}, api.Conflict(err.Error())
+			}
+			return s.signaling.Status(), nil
+		})
+
+	api.Handle(r, "GET", "/tracks", "Loaded tracks",
+		func(c *fiber.Ctx, req *api.NoBody) (TracksResponse, error) {
+			resp := TracksResponse{Tracks: []TrackInfo{}}
+			for _, name := range s.trackNames {
+				t := s.tracks[name]
+				info := TrackInfo{Name: name}
+				if t.Metadata.Author != nil {
+					info.Author = *t.Metadata.Author
+				}
+				info.ID, _ = t.GetTrackID()
+				resp.Tracks = append(resp.Tracks, info)
+			}
+			return resp, nil
+		})
+
+	api.Handle(r, "GET", "/track/layout", "Block layout of the current track",
+		func(c *fiber.Ctx, req *api.NoBody) (game.TrackLayout, error) {
+			track := s.game.Session().CurrentTrack
+			if track == nil {
+				return game.TrackLayout{}, api.NotFound("No track loaded")
+			}
+			return game.NewTrackLayout(track), nil
+		})
+
+	// ---- SESSION ----
+
+	api.Handle(r, "GET", "/session", "Current session",
+		func(c *fiber.Ctx, req *api.NoBody) (SessionInfo, error) {
+			return s.sessionInfo(), nil
+		})
+
+	api.Handle(r, "PUT", "/session", "Switch to a new session, start it with POST /session/start",
+		func(c *fiber.Ctx, req *SetSessionRequest) (SessionInfo, error) {
+			t, ok := s.tracks[req.Track]
+			if !ok {
+				return SessionInfo{}, api.NotFound("Track not found")
+			}
+			session := game.GameSession{
+				GameMode:          req.GameMode,
+				SwitchingSession:  true,
+				CurrentTrack:      t,
+				MaxPlayers:        req.MaxPlayers,
+				CarUpdateInterval: req.CarUpdateInterval,
+				PingInterval:      req.PingInterval,
+			}
+			if err := validateSession(session); err != nil {
+				return SessionInfo{}, api.BadRequest(err.Error())
+			}
+			s.game.UpdateGameSession(session)
+			logger.Info("Got new session data", "track", req.Track, "gamemode", req.GameMode, "maxPlayers", req.MaxPlayers)
+			return s.sessionInfo(), nil
+		})
+
+	api.Handle(r, "POST", "/session/start", "Start the current session",
+		func(c *fiber.Ctx, req *api.NoBody) (SessionInfo, error) {
+			if err := s.game.StartSession(); err != nil {
+				return SessionInfo{}, api.Conflict(err.Error())
+			}
+			logger.Info("Starting session...")
+			return s.sessionInfo(), nil
+		})
+
+	api.Handle(r, "POST", "/session/end", "End the current session",
+		func(c *fiber.Ctx, req *api.NoBody) (SessionInfo, error) {
+			if err := s.game.EndSession(); err != nil {
+				return SessionInfo{}, api.Conflict(err.Error())
+			}
+			logger.Info("Ending session...")
+			return s.sessionInfo(), nil
+		})
+
+	// ---- PLAYERS ----
+
+	api.Handle(r, "GET", "/players", "Connected players",
+		func(c *fiber.Ctx, req *api.NoBody) (PlayersResponse, error) {
+			resp := PlayersResponse{Players: []PlayerInfo{}}
+			for _, p := range s.game.Players() {
+				resp.Players = append(resp.Players, PlayerInfo{
+					ID:           p.ID,
+					Nickname:     p.Nickname,
+					CountryCode:  p.CountryCode,
+					Frames:       p.Frames,
+					Ping:         p.Ping,
+					ResetCounter: p.ResetCounter,
+					Spectating:   p.Spectating,
+				})
+			}
+			return resp, nil
+		})
+
+	api.Handle(r, "POST", "/players/:id/kick", "Kick a player",
+		func(c *fiber.Ctx, req *PlayerRequest) (api.NoBody, error) {
+			if !s.game.KickPlayer(req.ID) {
+				return api.NoBody{}, api.NotFound("Player not found")
+			}
+			return api.NoBody{}, nil
+		})
+
+	api.Handle(r, "PUT", "/players/:id/spectate", "Set the car a player watches",
+		func(c *fiber.Ctx, req *SpectateRequest) (api.NoBody, error) {
+			if err := s.game.Spectate(req.ID, req.Target); err != nil {
+				return api.NoBody{}, api.NotFound("Player not found")
+			}
+			return api.NoBody{}, nil
+		})
+
+	api.Handle(r, "GET", "/players/:id/ice", "ICE connection details of a player",
+		func(c *fiber.Ctx, req *PlayerRequest) (game.PlayerICE, error) {
+			ice, ok := s.game.PlayerICEDiagnostics(req.ID)
+			if !ok {
+				return game.PlayerICE{}, api.NotFound("Player not found")
+			}
+			return ice, nil
+		})
+
+	api.Handle(r, "GET", "/players/:id/net", "Network quality of a player",
+		func(c *fiber.Ctx, req *PlayerRequest) (game.PlayerNet, error) {
+			net, ok := s.game.PlayerNetStats(req.ID)
+			if !ok {
+				return game.PlayerNet{}, api.NotFound("Player not found")
+			}
+			return net, nil
+		})
+
+	api.Handle(r, "GET", "/ice", "ICE connection details of every player",
+		func(c *fiber.Ctx, req *api.NoBody) (ICEResponse, error) {
+			return ICEResponse{Players: s.game.ICEDiagnostics()}, nil
+		})
+
+	api.Handle(r, "GET", "/standings", "Live race standings of the current session",
+		func(c *fiber.Ctx, req *api.NoBody) (StandingsResponse, error) {
+			return StandingsResponse{
+				SessionID: s.game.Session().SessionID,
+				Standings: s.game.Standings(),
+			}, nil
+		})
+
+	// ---- SESSION ARCHIVE ----
+
+	api.Handle(r, "GET", "/sessions", "Archived session results, newest first",
+		func(c *fiber.Ctx, req *api.NoBody) (SessionsResponse, error) {
+			list, err := s.archive.List()
+			if err != nil {
+				return SessionsResponse{}, api.Internal(err.Error())
+			}
+			if list == nil {
+				list = []*game.SessionSummary{}
+			}
+			return SessionsResponse{Sessions: list}, nil
+		})
+
+	api.Handle(r, "GET", "/sessions/:id", "Archived results of one session",
+		func(c *fiber.Ctx, req *SessionRequest) (*game.SessionSummary, error) {
+			summary, err := s.archive.Get(req.ID)
+			if err != nil {
+				return nil, api.NotFound("Session not found")
+			}
+			return summary, nil
+		})
+
+	// ---- TOURNAMENT ----
+
+	api.Handle(r, "GET", "/tournament", "Current tournament",
+		func(c *fiber.Ctx, req *api.NoBody) (*tournament.Tournament, error) {
+			t := s.tournaments.Get()
+			if t == nil {
+				return nil, api.NotFound("No tournament")
+			}
+			return t, nil
+		})
+
+	api.Handle(r, "POST", "/tournament", "Create a tournament, replacing the current one",
+		func(c *fiber.Ctx, req *CreateTournamentRequest) (*tournament.Tournament, error) {
+			if err := s.tournaments.Create(req.Name, req.HeatSize, req.Rounds, req.Players); err != nil {
+				return nil, api.BadRequest(err.Error())
+			}
+			return s.tournaments.Get(), nil
+		})
+
+	api.Handle(r, "DELETE", "/tournament", "Delete the current tournament",
+		func(c *fiber.Ctx, req *api.NoBody) (api.NoBody, error) {
+			if err := s.tournaments.Reset(); err != nil {
+				return api.NoBody{}, api.Internal(err.Error())
+			}
+			return api.NoBody{}, nil
+		})
+
+	api.Handle(r, "POST", "/tournament/heats/:index/start", "Start a heat of the current round",
+		func(c *fiber.Ctx, req *HeatRequest) (*tournament.Tournament, error) {
+			if err := s.tournaments.StartHeat(req.Index); err != nil {
+				return nil, api.Conflict(err.Error())
+			}
+			return s.tournaments.Get(), nil
+		})
+
+	api.Handle(r, "POST", "/tournament/heats/running/finish", "Finish the running heat and record its results",
+		func(c *fiber.Ctx, req *api.NoBody) (*tournament.Tournament, error) {
+			if err := s.tournaments.FinishHeat(); err != nil {
+				return nil, api.Conflict(err.Error())
+			}
+			return s.tournaments.Get(), nil
+		})
+
+	// ---- OPERATIONS ----
+
+	api.Handle(r, "GET", "/log/level", "Log levels by subsystem",
+		func(c *fiber.Ctx, req *api.NoBody) (map[string]string, error) {
+			return logging.Levels(), nil
+		})
+
+	api.Handle(r, "PUT", "/log/level", "Change the log level of a subsystem, empty for the default",
+		func(c *fiber.Ctx, req *LogLevelRequest) (map[string]string, error) {
+			if err := logging.SetLevel(req.Subsystem, req.Level); err != nil {
+				return nil, api.BadRequest(err.Error())
+			}
+			logger.Info("Log level changed", "subsystem", req.Subsystem, "level", req.Level)
+			return logging.Levels(), nil
+		})
+
+	api.Handle(r, "POST", "/drain", "Shut the server down gracefully, the notice goes to the event stream",
+		func(c *fiber.Ctx, req *DrainRequest) (api.NoBody, error) {
+			s.drain(req.Notice)
+			return api.NoBody{}, nil
+		})
+
+	r.Raw("GET", "/metrics", "Prometheus metrics", "text/plain", func(c *fiber.Ctx) error {
+		c.Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.Default.WriteText(c)
+		return nil
+	})
+
+	r.Raw("GET", "/events", "Live events as Server-Sent Events, filter with ?types=a,b", "text/event-stream", func(c *fiber.Ctx) error {
+		filter := map[string]bool{}
+		for _, t := range strings.Split(c.Query("types"), ",") {
+			if t != "" {
+				filter[t] = true
+			}
+		}
+		return streamEvents(c, s.game.Events, filter)
+	})
+
+	// Anything else under the prefix gets a proper error body too
+	app.Use(r.Prefix, func(c *fiber.Ctx) error {
+		return api.WriteError(c, api.NotFound(fmt.Sprintf("No route %s %s", c.Method(), c.Path())))
+	})
+}
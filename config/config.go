@@ -1,11 +1,409 @@
 package config
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Startup settings, set from the config by Apply. They can't change while the
+// server runs.
 var PolyVersion = "0.6.0-beta1"
 var ApiVersion = "v6"
 
 var IceFetchUrl = "https://vps.kodub.com:43274/" + ApiVersion + "/iceServers?version=" + PolyVersion
 var WebsocketUrl = "wss://vps.kodub.com:43274/" + ApiVersion + "/multiplayer/host"
 
-var AcceptVanillaClients = true
+// Duration is a time.Duration written as "1s", "500ms" in config files
+type Duration time.Duration
+
+// String and Set make Duration usable with flag.Var
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1s\": %w", err)
+	}
+	return d.Set(s)
+}
+
+type SignalingConfig struct {
+	// "kodub" connects to websocketUrl, "local" runs a built-in signaling
+	// server in the same process
+	Mode string `json:"mode"`
+	// Address of the built-in signaling server
+	Listen string `json:"listen"`
+
+	// How long invites of the built-in server last, 0 never expires them
+	InviteTimeout Duration `json:"inviteTimeout"`
+	// Invites are replaced this long before they expire
+	InviteRefreshBefore Duration `json:"inviteRefreshBefore"`
+
+	// A lost signaling connection is retried with a doubling, jittered delay
+	ReconnectBackoff     Duration `json:"reconnectBackoff"`
+	ReconnectMaxBackoff  Duration `json:"reconnectMaxBackoff"`
+	ReconnectMaxAttempts int      `json:"reconnectMaxAttempts"` // 0 retries forever
+}
+
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"`
+}
+
+type ICEConfig struct {
+	// Used instead of fetching the ICE servers from kodub when not empty. In
+	// local signaling mode an empty list only works on a LAN.
+	Servers []ICEServerConfig `json:"servers"`
+	// "all", or "relay" to only connect through TURN servers
+	TransportPolicy string `json:"transportPolicy"`
+	// UDP ports to gather candidates on, 0 lets the OS pick
+	PortMin int `json:"portMin"`
+	PortMax int `json:"portMax"`
+	// Addresses of a 1:1 NAT in front of the server. "host" announces them
+	// instead of the local addresses, "srflx" adds them as server reflexive
+	// candidates.
+	PublicIPs             []string `json:"publicIPs"`
+	PublicIPCandidateType string   `json:"publicIPCandidateType"`
+}
+
+type SessionConfig struct {
+	// Track loaded at startup, empty for the first one
+	Track      string `json:"track"`
+	GameMode   string `json:"gamemode"` // "casual" or "competitive"
+	MaxPlayers int    `json:"maxPlayers"`
+}
+
+type TimingConfig struct {
+	PingInterval      Duration `json:"pingInterval"`
+	CarUpdateInterval Duration `json:"carUpdateInterval"`
+	StandingsInterval Duration `json:"standingsInterval"`
+	StateSaveInterval Duration `json:"stateSaveInterval"`
+	DrainGrace        Duration `json:"drainGrace"`
+	ShutdownTimeout   Duration `json:"shutdownTimeout"`
+
+	// Stretches the car update interval up to maxCarUpdateInterval while the
+	// server or the players can't keep up
+	AdaptiveCarUpdates   bool     `json:"adaptiveCarUpdates"`
+	MaxCarUpdateInterval Duration `json:"maxCarUpdateInterval"`
+}
+
+type NetworkConfig struct {
+	// Number of recent pings the RTT, jitter and pong loss of a player are
+	// computed from
+	PingWindow int `json:"pingWindow"`
+	// A ping without a pong after pongTimeout, or after the ping interval
+	// when that's longer, counts as lost
+	PongTimeout Duration `json:"pongTimeout"`
+
+	// Players are kicked when their ping stays above maxPing for
+	// maxPingWindow, when maxMissedPongs pings in a row go unanswered, or
+	// when they send no car update for idleTimeout during a session. 0
+	// disables a policy.
+	MaxPing        int      `json:"maxPing"` // milliseconds
+	MaxPingWindow  Duration `json:"maxPingWindow"`
+	MaxMissedPongs int      `json:"maxMissedPongs"`
+	IdleTimeout    Duration `json:"idleTimeout"`
+
+	// Packets are handed to a data channel while less than sendBuffer bytes
+	// wait in it, the rest is queued. A player whose reliable queue grows
+	// past reliableQueueLimit bytes is disconnected, the oldest car updates
+	// are dropped once the unreliable queue passes unreliableQueueLimit.
+	SendBuffer           int `json:"sendBuffer"`
+	ReliableQueueLimit   int `json:"reliableQueueLimit"`
+	UnreliableQueueLimit int `json:"unreliableQueueLimit"`
+
+	// Cars within nearDistance of the car a player watches are sent every
+	// car update, cars within farDistance every midInterval updates and the
+	// rest every farInterval updates. A player gets at most maxCars cars per
+	// update, 0 sends all of them.
+	MaxCars      int     `json:"maxCars"`
+	NearDistance float64 `json:"nearDistance"`
+	FarDistance  float64 `json:"farDistance"`
+	MidInterval  int     `json:"midInterval"`
+	FarInterval  int     `json:"farInterval"`
+
+	// zlib level car updates are compressed with, from 1 (fastest) to 9
+	// (smallest)
+	CompressionLevel int `json:"compressionLevel"`
+}
+
+type LogConfig struct {
+	Format      string   `json:"format"`
+	Level       string   `json:"level"`
+	Levels      string   `json:"levels"`
+	File        string   `json:"file"`
+	MaxSizeMB   int      `json:"maxSizeMB"`
+	RotateEvery Duration `json:"rotateEvery"`
+	MaxBackups  int      `json:"maxBackups"`
+	MaxAge      Duration `json:"maxAge"`
+}
+
+// Config holds every server setting. Values come from the defaults, then the
+// config file, then POLYSERVER_* environment variables, then command line
+// flags.
+type Config struct {
+	PolyVersion          string   `json:"polyVersion"`
+	ApiVersion           string   `json:"apiVersion"`
+	IceFetchUrl          string   `json:"iceFetchUrl"`  // empty derives it from the versions
+	WebsocketUrl         string   `json:"websocketUrl"` // empty derives it from the versions
+	AcceptVanillaClients bool     `json:"acceptVanillaClients"`
+	Mods                 []string `json:"mods"`
+
+	ControlPort    int    `json:"controlPort"`
+	OverlayPort    int    `json:"overlayPort"`
+	OverlayBind    string `json:"overlayBind"`
+	TracksDir      string `json:"tracksDir"`
+	SessionsDir    string `json:"sessionsDir"`
+	StateFile      string `json:"stateFile"`
+	TournamentFile string `json:"tournamentFile"`
+
+	Signaling SignalingConfig `json:"signaling"`
+	ICE       ICEConfig       `json:"ice"`
+	Session   SessionConfig   `json:"session"`
+	Timing    TimingConfig    `json:"timing"`
+	Network   NetworkConfig   `json:"network"`
+	Log       LogConfig       `json:"log"`
+}
+
+func Default() *Config {
+	return &Config{
+		PolyVersion:          "0.6.0-beta1",
+		ApiVersion:           "v6",
+		AcceptVanillaClients: true,
+		Mods:                 []string{},
+
+		ControlPort:    9090,
+		OverlayBind:    "0.0.0.0",
+		TracksDir:      "tracks/official",
+		SessionsDir:    "sessions",
+		StateFile:      "state.json",
+		TournamentFile: "tournament.json",
+
+		Signaling: SignalingConfig{
+			Mode:   "kodub",
+			Listen: "0.0.0.0:43274",
+
+			InviteRefreshBefore: Duration(30 * time.Second),
+
+			ReconnectBackoff:    Duration(time.Second),
+			ReconnectMaxBackoff: Duration(30 * time.Second),
+		},
+		ICE: ICEConfig{
+			Servers:               []ICEServerConfig{},
+			TransportPolicy:       "all",
+			PublicIPs:             []string{},
+			PublicIPCandidateType: "host",
+		},
+		Session: SessionConfig{
+			GameMode:   "competitive",
+			MaxPlayers: 200,
+		},
+		Timing: TimingConfig{
+			PingInterval:      Duration(time.Second),
+			CarUpdateInterval: Duration(100 * time.Millisecond),
+			StandingsInterval: Duration(500 * time.Millisecond),
+			StateSaveInterval: Duration(5 * time.Second),
+			DrainGrace:        Duration(2 * time.Second),
+			ShutdownTimeout:   Duration(5 * time.Second),
+
+			MaxCarUpdateInterval: Duration(500 * time.Millisecond),
+		},
+		Network: NetworkConfig{
+			PingWindow:     20,
+			PongTimeout:    Duration(3 * time.Second),
+			MaxPingWindow:  Duration(10 * time.Second),
+			MaxMissedPongs: 10,
+
+			SendBuffer:           64 * 1024,
+			ReliableQueueLimit:   4 * 1024 * 1024,
+			UnreliableQueueLimit: 64 * 1024,
+
+			MaxCars:      64,
+			NearDistance: 100,
+			FarDistance:  400,
+			MidInterval:  2,
+			FarInterval:  5,
+
+			CompressionLevel: 6,
+		},
+		Log: LogConfig{
+			Format:      "text",
+			Level:       "info",
+			File:        "polyserver.log",
+			MaxSizeMB:   50,
+			RotateEvery: Duration(24 * time.Hour),
+			MaxBackups:  7,
+		},
+	}
+}
+
+// Load reads the defaults, the config file at path if it isn't empty and the
+// environment overrides. The result still has to be validated once flags
+// are applied.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+		decoder := json.NewDecoder(strings.NewReader(string(data)))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("invalid config %s: %w", path, err)
+		}
+	}
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks every setting and reports all problems at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.PolyVersion != "", "polyVersion is required")
+	check(c.ApiVersion != "", "apiVersion is required")
+	check(validPort(c.ControlPort), "controlPort %d is not a valid port", c.ControlPort)
+	check(c.OverlayPort == 0 || validPort(c.OverlayPort), "overlayPort %d is not a valid port", c.OverlayPort)
+	check(c.OverlayPort == 0 || c.OverlayPort != c.ControlPort, "overlayPort can't be the same as controlPort")
+	check(c.TracksDir != "", "tracksDir is required")
+	check(c.SessionsDir != "", "sessionsDir is required")
+	check(c.StateFile != "", "stateFile is required")
+	check(c.TournamentFile != "", "tournamentFile is required")
+
+	check(c.Signaling.Mode == "kodub" || c.Signaling.Mode == "local", "signaling.mode must be kodub or local, got %q", c.Signaling.Mode)
+	if c.Signaling.Mode == "local" {
+		_, port, err := net.SplitHostPort(c.Signaling.Listen)
+		n, _ := strconv.Atoi(port)
+		check(err == nil && validPort(n), "signaling.listen %q must be an address like 0.0.0.0:43274", c.Signaling.Listen)
+	}
+
+	check(c.Signaling.InviteTimeout >= 0, "signaling.inviteTimeout can't be negative")
+	check(c.Signaling.InviteRefreshBefore >= 0, "signaling.inviteRefreshBefore can't be negative")
+	check(c.Signaling.ReconnectBackoff > 0, "signaling.reconnectBackoff must be positive")
+	check(c.Signaling.ReconnectMaxBackoff >= c.Signaling.ReconnectBackoff, "signaling.reconnectMaxBackoff can't be shorter than signaling.reconnectBackoff")
+	check(c.Signaling.ReconnectMaxAttempts >= 0, "signaling.reconnectMaxAttempts can't be negative")
+
+	for i, server := range c.ICE.Servers {
+		check(len(server.URLs) > 0, "ice.servers[%d] has no urls", i)
+	}
+	check(c.ICE.TransportPolicy == "all" || c.ICE.TransportPolicy == "relay", "ice.transportPolicy must be all or relay, got %q", c.ICE.TransportPolicy)
+	check(c.ICE.PortMin == 0 && c.ICE.PortMax == 0 || validPort(c.ICE.PortMin) && validPort(c.ICE.PortMax) && c.ICE.PortMin <= c.ICE.PortMax, "ice.portMin and ice.portMax must be a valid port range")
+	for _, ip := range c.ICE.PublicIPs {
+		check(net.ParseIP(ip) != nil, "ice.publicIPs: %q is not an IP address", ip)
+	}
+	check(c.ICE.PublicIPCandidateType == "host" || c.ICE.PublicIPCandidateType == "srflx", "ice.publicIPCandidateType must be host or srflx, got %q", c.ICE.PublicIPCandidateType)
+
+	check(c.Session.GameMode == "casual" || c.Session.GameMode == "competitive", "session.gamemode must be casual or competitive, got %q", c.Session.GameMode)
+	// Sent to clients as a single byte
+	check(c.Session.MaxPlayers >= 1 && c.Session.MaxPlayers <= 255, "session.maxPlayers must be between 1 and 255")
+
+	check(c.Timing.PingInterval > 0, "timing.pingInterval must be positive")
+	check(c.Timing.CarUpdateInterval > 0, "timing.carUpdateInterval must be positive")
+	check(c.Timing.StandingsInterval > 0, "timing.standingsInterval must be positive")
+	check(c.Timing.StateSaveInterval > 0, "timing.stateSaveInterval must be positive")
+	check(c.Timing.DrainGrace >= 0, "timing.drainGrace can't be negative")
+	check(c.Timing.ShutdownTimeout > 0, "timing.shutdownTimeout must be positive")
+	check(c.Timing.MaxCarUpdateInterval >= c.Timing.CarUpdateInterval, "timing.maxCarUpdateInterval can't be shorter than timing.carUpdateInterval")
+
+	check(c.Network.PingWindow >= 1, "network.pingWindow must be at least 1")
+	check(c.Network.PongTimeout > 0, "network.pongTimeout must be positive")
+	check(c.Network.MaxPing >= 0, "network.maxPing can't be negative")
+	check(c.Network.MaxPingWindow >= 0, "network.maxPingWindow can't be negative")
+	check(c.Network.MaxMissedPongs >= 0, "network.maxMissedPongs can't be negative")
+	check(c.Network.IdleTimeout >= 0, "network.idleTimeout can't be negative")
+	check(c.Network.SendBuffer > 0, "network.sendBuffer must be positive")
+	check(c.Network.ReliableQueueLimit > 0, "network.reliableQueueLimit must be positive")
+	check(c.Network.UnreliableQueueLimit > 0, "network.unreliableQueueLimit must be positive")
+	check(c.Network.MaxCars >= 0, "network.maxCars can't be negative")
+	check(c.Network.NearDistance >= 0, "network.nearDistance can't be negative")
+	check(c.Network.FarDistance >= c.Network.NearDistance, "network.farDistance can't be shorter than network.nearDistance")
+	check(c.Network.MidInterval >= 1, "network.midInterval must be at least 1")
+	check(c.Network.FarInterval >= c.Network.MidInterval, "network.farInterval can't be shorter than network.midInterval")
+	check(c.Network.CompressionLevel >= 1 && c.Network.CompressionLevel <= 9, "network.compressionLevel must be between 1 and 9")
+
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format must be text or json, got %q", c.Log.Format)
+	check(validLevel(c.Log.Level), "log.level %q is not a log level", c.Log.Level)
+	for _, pair := range strings.Split(c.Log.Levels, ",") {
+		if pair == "" {
+			continue
+		}
+		_, level, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		check(ok && validLevel(level), "log.levels entry %q must look like game=debug", pair)
+	}
+	check(c.Log.MaxSizeMB >= 0, "log.maxSizeMB can't be negative")
+	check(c.Log.MaxBackups >= 0, "log.maxBackups can't be negative")
+
+	return errors.Join(errs...)
+}
+
+func validLevel(s string) bool {
+	var level slog.Level
+	return s == "" || level.UnmarshalText([]byte(s)) == nil
+}
+
+func validPort(port int) bool {
+	return port > 0 && port < 65536
+}
+
+//
+// CURRENT CONFIG
+//
+
+var current atomic.Pointer[Config]
+
+func init() {
+	current.Store(Default())
+}
+
+// Current returns the config in use. Settings that can be reloaded must be
+// read through it instead of being copied at startup.
+func Current() *Config {
+	return current.Load()
+}
 
-var LoadedMods []string = []string{}
+// Apply makes cfg the current config and sets the startup globals from it
+func Apply(cfg *Config) {
+	PolyVersion = cfg.PolyVersion
+	ApiVersion = cfg.ApiVersion
+	IceFetchUrl = cfg.IceFetchUrl
+	if IceFetchUrl == "" {
+		IceFetchUrl = "https://vps.kodub.com:43274/" + ApiVersion + "/iceServers?version=" + PolyVersion
+	}
+	WebsocketUrl = cfg.WebsocketUrl
+	if WebsocketUrl == "" {
+		WebsocketUrl = "wss://vps.kodub.com:43274/" + ApiVersion + "/multiplayer/host"
+	}
+	current.Store(cfg)
+}
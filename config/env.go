@@ -0,0 +1,124 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const envPrefix = "POLYSERVER_"
+
+// EnvName is the environment variable overriding the setting at path, e.g.
+// "session.maxPlayers" is POLYSERVER_SESSION_MAX_PLAYERS
+func EnvName(path string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, part := range strings.Split(path, ".") {
+		if i > 0 {
+			b.WriteByte('_')
+		}
+		for j, r := range part {
+			if unicode.IsUpper(r) && j > 0 && !unicode.IsUpper(rune(part[j-1])) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+// fields calls fn with the JSON path and value of every setting in cfg
+func fields(cfg *Config, fn func(path string, v reflect.Value)) {
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			path := prefix + name
+			field := v.Field(i)
+			if field.Kind() == reflect.Struct {
+				walk(path+".", field)
+				continue
+			}
+			fn(path, field)
+		}
+	}
+	walk("", reflect.ValueOf(cfg).Elem())
+}
+
+var durationType = reflect.TypeFor[Duration]()
+
+func applyEnv(cfg *Config, environ []string) error {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, envPrefix) {
+			env[k] = v
+		}
+	}
+
+	var err error
+	fields(cfg, func(path string, v reflect.Value) {
+		value, ok := env[EnvName(path)]
+		if !ok || err != nil {
+			return
+		}
+		if setErr := setString(v, value); setErr != nil {
+			err = fmt.Errorf("invalid %s: %w", EnvName(path), setErr)
+		}
+	})
+	return err
+}
+
+// setString parses s into v according to its type
+func setString(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		// Lists of objects are given as JSON
+		if v.Type().Elem().Kind() != reflect.String {
+			return json.Unmarshal([]byte(s), v.Addr().Interface())
+		}
+		list := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"time"
+)
+
+// Settings that take effect while the server runs. Everything else needs a
+// restart.
+var reloadable = map[string]bool{
+	"acceptVanillaClients":        true,
+	"mods":                        true,
+	"log.level":                   true,
+	"log.levels":                  true,
+	"timing.pingInterval":         true,
+	"timing.carUpdateInterval":    true,
+	"timing.adaptiveCarUpdates":   true,
+	"timing.maxCarUpdateInterval": true,
+	"network.pingWindow":          true,
+	"network.pongTimeout":         true,
+	"network.maxPing":             true,
+	"network.maxPingWindow":       true,
+	"network.maxMissedPongs":      true,
+	"network.idleTimeout":         true,
+	"network.maxCars":             true,
+	"network.nearDistance":        true,
+	"network.farDistance":         true,
+	"network.midInterval":         true,
+	"network.farInterval":         true,
+	"network.compressionLevel":    true,
+}
+
+func Reloadable(path string) bool {
+	return reloadable[path]
+}
+
+// Changed lists the paths of the settings that differ between a and b
+func Changed(a, b *Config) []string {
+	values := map[string]any{}
+	fields(a, func(path string, v reflect.Value) {
+		values[path] = v.Interface()
+	})
+	var changed []string
+	fields(b, func(path string, v reflect.Value) {
+		if !reflect.DeepEqual(values[path], v.Interface()) {
+			changed = append(changed, path)
+		}
+	})
+	return changed
+}
+
+// Merge returns a copy of dst with the settings at paths taken from src
+func Merge(dst, src *Config, paths []string) *Config {
+	merged := *dst
+	take := map[string]bool{}
+	for _, path := range paths {
+		take[path] = true
+	}
+	values := map[string]reflect.Value{}
+	fields(src, func(path string, v reflect.Value) {
+		values[path] = v
+	})
+	fields(&merged, func(path string, v reflect.Value) {
+		if take[path] {
+			v.Set(values[path])
+		}
+	})
+	return &merged
+}
+
+// Watch polls the file at path and calls onChange with the new config
+// whenever it's modified, or onError if it can't be loaded. It stops when
+// stop is closed.
+func Watch(path string, interval time.Duration, stop <-chan struct{}, onChange func(*Config), onError func(error)) {
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+
+	last := modTime()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		mod := modTime()
+		if mod.Equal(last) {
+			continue
+		}
+		last = mod
+
+		cfg, err := Load(path)
+		if err == nil {
+			err = cfg.Validate()
+		}
+		if err != nil {
+			onError(err)
+			continue
+		}
+		onChange(cfg)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"polyserver/config"
+	"polyserver/logging"
+	"strings"
+	"time"
+)
+
+// configPath finds the -config flag in args before the flags are parsed
+func configPath(args []string) string {
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// watchConfig applies the reloadable settings whenever the config file at path
+// changes, and warns about the ones that need a restart. loaded is the config
+// as read from the file at startup, before flags were applied.
+func watchConfig(path string, loaded *config.Config, stop <-chan struct{}) {
+	previous := loaded
+	config.Watch(path, 2*time.Second, stop, func(next *config.Config) {
+		var reload, restart []string
+		for _, setting := range config.Changed(previous, next) {
+			if config.Reloadable(setting) {
+				reload = append(reload, setting)
+			} else {
+				restart = append(restart, setting)
+			}
+		}
+		previous = next
+
+		if len(restart) > 0 {
+			logger.Warn("Config changes need a restart to take effect", "settings", strings.Join(restart, ","))
+		}
+		if len(reload) == 0 {
+			return
+		}
+
+		cfg := config.Merge(config.Current(), next, reload)
+		if err := logging.SetLevels(cfg.Log.Level, cfg.Log.Levels); err != nil {
+			logger.Error("Failed to reload config", "file", path, "err", err)
+			return
+		}
+		config.Apply(cfg)
+		logger.Info("Reloaded config", "file", path, "settings", strings.Join(reload, ","))
+	}, func(err error) {
+		logger.Error("Failed to reload config, keeping the current one", "file", path, "err", err)
+	})
+}
@@ -0,0 +1,75 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	PlayerJoin  = "player.join"
+	PlayerLeave = "player.leave"
+	Record      = "player.record"
+	Reset       = "player.reset"
+	Pings       = "pings"
+	Session     = "session"
+	Invite      = "invite"
+	Standings   = "standings"
+	Drain       = "server.drain"
+	Signaling   = "signaling"
+)
+
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+// Bus fans events out to every subscriber. Slow subscribers miss events
+// instead of blocking the publisher.
+type Bus struct {
+	lock        sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+func (b *Bus) Publish(eventType string, data any) {
+	event := Event{
+		Type: eventType,
+		Time: time.Now(),
+		Data: data,
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every published event and a function
+// that unsubscribes and closes it
+func (b *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	b.lock.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.lock.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.lock.Lock()
+			delete(b.subscribers, ch)
+			b.lock.Unlock()
+			close(ch)
+		})
+	}
+}
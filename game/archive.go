@@ -0,0 +1,289 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionSummary is the snapshot of a session kept after it ends
+type SessionSummary struct {
+	SessionID    uint32         `json:"sessionId"`
+	TrackName    string         `json:"trackName"`
+	TrackID      string         `json:"trackId"`
+	GameMode     GameMode       `json:"gamemode"`
+	StartedAt    time.Time      `json:"startedAt"`
+	EndedAt      time.Time      `json:"endedAt"`
+	Participants []*Participant `json:"participants"`
+}
+
+type Participant struct {
+	ID           uint32    `json:"id"`
+	Nickname     string    `json:"nickname"`
+	CountryCode  *string   `json:"countryCode"`
+	FinishFrames *uint32   `json:"finishFrames"`
+	Resets       uint32    `json:"resets"`
+	Ping         PingStats `json:"ping"`
+}
+
+type PingStats struct {
+	Samples int     `json:"samples"`
+	Min     int     `json:"min"`
+	Max     int     `json:"max"`
+	Avg     float64 `json:"avg"`
+	sum     int
+}
+
+func (ps *PingStats) add(ping int) {
+	if ps.Samples == 0 || ping < ps.Min {
+		ps.Min = ping
+	}
+	if ping > ps.Max {
+		ps.Max = ping
+	}
+	ps.Samples++
+	ps.sum += ping
+	ps.Avg = float64(ps.sum) / float64(ps.Samples)
+}
+
+//
+// SESSION RECORDER
+//
+
+// sessionRecorder collects the results of the running session
+type sessionRecorder struct {
+	lock         sync.Mutex
+	summary      *SessionSummary
+	participants map[uint32]*Participant
+}
+
+func (r *sessionRecorder) start(session *GameSession) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	summary := &SessionSummary{
+		SessionID: session.SessionID,
+		GameMode:  session.GameMode,
+		StartedAt: time.Now(),
+	}
+	if session.CurrentTrack != nil {
+		summary.TrackName = session.CurrentTrack.Metadata.Name
+		if trackId, err := session.CurrentTrack.GetTrackID(); err == nil {
+			summary.TrackID = trackId
+		}
+	}
+	r.summary = summary
+	r.participants = make(map[uint32]*Participant)
+}
+
+// finish closes the running session and returns its summary, or nil if no
+// session was running
+func (r *sessionRecorder) finish() *SessionSummary {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	summary := r.summary
+	if summary == nil {
+		return nil
+	}
+	r.summary = nil
+
+	summary.EndedAt = time.Now()
+	for _, p := range r.participants {
+		summary.Participants = append(summary.Participants, p)
+	}
+	sortParticipants(summary.Participants)
+	return summary
+}
+
+func (r *sessionRecorder) participant(player *Player) *Participant {
+	p, ok := r.participants[player.ID]
+	if !ok {
+		p = &Participant{
+			ID:          player.ID,
+			Nickname:    player.Nickname,
+			CountryCode: player.CountryCode,
+		}
+		r.participants[player.ID] = p
+	}
+	return p
+}
+
+func (r *sessionRecorder) join(player *Player) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.summary == nil {
+		return
+	}
+	r.participant(player)
+}
+
+func (r *sessionRecorder) record(player *Player, frames uint32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.summary == nil {
+		return
+	}
+	p := r.participant(player)
+	if p.FinishFrames == nil || frames < *p.FinishFrames {
+		p.FinishFrames = &frames
+	}
+}
+
+func (r *sessionRecorder) reset(player *Player, resets uint32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.summary == nil {
+		return
+	}
+	r.participant(player).Resets = resets
+}
+
+func (r *sessionRecorder) ping(player *Player, ping int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.summary == nil {
+		return
+	}
+	r.participant(player).Ping.add(ping)
+}
+
+// snapshot copies the results of the running session so far, or returns nil
+// if no session is running
+func (r *sessionRecorder) snapshot() *SessionSummary {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.summary == nil {
+		return nil
+	}
+	summary := *r.summary
+	summary.Participants = nil
+	for _, p := range r.participants {
+		participant := *p
+		summary.Participants = append(summary.Participants, &participant)
+	}
+	sortParticipants(summary.Participants)
+	return &summary
+}
+
+// startedAt returns when the running session started
+func (r *sessionRecorder) startedAt() (time.Time, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.summary == nil {
+		return time.Time{}, false
+	}
+	return r.summary.StartedAt, true
+}
+
+// sortParticipants puts finishers first by time, then everyone else by name
+func sortParticipants(participants []*Participant) {
+	sort.SliceStable(participants, func(i, j int) bool {
+		a, b := participants[i], participants[j]
+		if a.FinishFrames != nil && b.FinishFrames != nil {
+			return *a.FinishFrames < *b.FinishFrames
+		}
+		if a.FinishFrames != nil || b.FinishFrames != nil {
+			return a.FinishFrames != nil
+		}
+		return a.Nickname < b.Nickname
+	})
+}
+
+//
+// ARCHIVE
+//
+
+// SessionArchive stores session summaries as one JSON file per session
+type SessionArchive struct {
+	Dir string
+}
+
+func NewSessionArchive(dir string) (*SessionArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create session archive: %w", err)
+	}
+	return &SessionArchive{Dir: dir}, nil
+}
+
+func (a *SessionArchive) Save(summary *SessionSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Session IDs restart with the server, the start time keeps names unique
+	path := filepath.Join(a.Dir, fmt.Sprintf("session-%d-%d.json", summary.SessionID, summary.StartedAt.Unix()))
+	// List skips the temp file, so a crash never leaves a half-written summary
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// List returns every archived session, newest first
+func (a *SessionArchive) List() ([]*SessionSummary, error) {
+	entries, err := os.ReadDir(a.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []*SessionSummary{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "session-") || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		if summary := a.read(filepath.Join(a.Dir, e.Name())); summary != nil {
+			list = append(list, summary)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].EndedAt.After(list[j].EndedAt)
+	})
+	return list, nil
+}
+
+// read loads an archived session, logging and returning nil if it can't
+func (a *SessionArchive) read(path string) *SessionSummary {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Warn("Could not read archived session", "file", filepath.Base(path), "err", err)
+		return nil
+	}
+	var summary SessionSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		logger.Warn("Invalid archived session", "file", filepath.Base(path), "err", err)
+		return nil
+	}
+	return &summary
+}
+
+// Get returns the most recent archived session with the given ID
+func (a *SessionArchive) Get(sessionID uint32) (*SessionSummary, error) {
+	// Only the files named after the session are read
+	paths, err := filepath.Glob(filepath.Join(a.Dir, fmt.Sprintf("session-%d-*.json", sessionID)))
+	if err != nil {
+		return nil, err
+	}
+	var latest *SessionSummary
+	for _, path := range paths {
+		summary := a.read(path)
+		if summary == nil || summary.SessionID != sessionID {
+			continue
+		}
+		if latest == nil || summary.EndedAt.After(latest.EndedAt) {
+			latest = summary
+		}
+	}
+	if latest == nil {
+		return nil, os.ErrNotExist
+	}
+	return latest, nil
+}
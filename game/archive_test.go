@@ -0,0 +1,42 @@
+package game
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionArchiveGet(t *testing.T) {
+	archive, err := NewSessionArchive(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1700000000, 0)
+	summaries := []*SessionSummary{
+		{SessionID: 1, TrackName: "old", StartedAt: start, EndedAt: start.Add(time.Minute)},
+		{SessionID: 1, TrackName: "new", StartedAt: start.Add(time.Hour), EndedAt: start.Add(time.Hour + time.Minute)},
+		{SessionID: 12, TrackName: "other", StartedAt: start.Add(2 * time.Hour), EndedAt: start.Add(3 * time.Hour)},
+	}
+	for _, summary := range summaries {
+		if err := archive.Save(summary); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tmp, _ := filepath.Glob(filepath.Join(archive.Dir, "*.tmp"))
+	if len(tmp) != 0 {
+		t.Errorf("temp files left: %v", tmp)
+	}
+	summary, err := archive.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.TrackName != "new" {
+		t.Errorf("got session on %q, want the latest one", summary.TrackName)
+	}
+	if _, err := archive.Get(2); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing session returned %v", err)
+	}
+}
@@ -6,19 +6,54 @@ import (
 	"encoding/binary"
 	"fmt"
 	gamepackets "polyserver/game/packets"
+	"slices"
 )
 
-// CarUpdateBatcher handles batching and splitting of car updates
+// CarUpdateBatcher handles batching and splitting of car updates. Every tick
+// each car's new states are encoded once, and the cars are split into fixed
+// groups of carsPerGroup that are compressed at most once. A player that gets
+// every car of a group is sent the group's packets, the other cars they get
+// go out in packets of their own, also compressed once per tick. Every
+// packet is shared by all players that get it, so compression work grows
+// with the number of cars rather than with cars times players.
 type CarUpdateBatcher struct {
 	maxChunkSize int // yn - 5 from JS
 	sessionID    uint32
-	Server       GameServer
+	level        int
+
+	// Encoded states of this tick by car ID
+	encoded map[uint32][][]byte
+	// Cars with states this tick in ID order, split into groups, and the
+	// group of each car
+	groups  [][]uint32
+	groupOf map[uint32]int
+	// Packets of this tick by group and by single car
+	groupPackets map[int][]carUpdatePacket
+	carPackets   map[uint32][]carUpdatePacket
+
+	// Setting up a zlib writer costs more than compressing a few cars, so
+	// one is reused until the level changes
+	writer      *zlib.Writer
+	writerLevel int
+}
+
+// Cars compressed together into shared packets
+const carsPerGroup = 8
+
+// carUpdatePacket is a ready to send car update packet
+type carUpdatePacket struct {
+	data   []byte
+	states int
 }
 
 func NewCarUpdateBatcher(sessionID uint32) *CarUpdateBatcher {
 	return &CarUpdateBatcher{
 		maxChunkSize: 16384 - 5, // Subtract header size (1 byte type + 4 bytes sessionID)
 		sessionID:    sessionID,
+		encoded:      make(map[uint32][][]byte),
+		groupOf:      make(map[uint32]int),
+		groupPackets: make(map[int][]carUpdatePacket),
+		carPackets:   make(map[uint32][]carUpdatePacket),
 	}
 }
 
@@ -45,74 +80,163 @@ func encodeCarStateExtended(extended *CarStateExtended) ([]byte, error) {
 	return buf, nil
 }
 
-// SendCarUpdates attempts to send a batch of car states, splitting if necessary
-func (b *CarUpdateBatcher) SendCarUpdates(player *Player, carStates []*CarStateExtended) error {
-	if len(carStates) == 0 {
-		return nil
-	}
+// StartTick forgets the previous tick, encodes the new states of every
+// player and groups their cars, compressing with the given zlib level from
+// now on
+func (b *CarUpdateBatcher) StartTick(players []*Player, level int) {
+	clear(b.encoded)
+	clear(b.groupOf)
+	clear(b.groupPackets)
+	clear(b.carPackets)
+	b.groups = b.groups[:0]
+	b.level = level
 
-	// Encode all car states to bytes with their headers
-	var stateBytes [][]byte
-	for _, state := range carStates {
-		data, err := encodeCarStateExtended(state)
-		if err != nil {
-			return fmt.Errorf("failed to encode car state: %w", err)
+	for _, player := range players {
+		for _, carState := range player.UnsentCarStates {
+			data, err := encodeCarStateExtended(&CarStateExtended{
+				ID:           player.ID,
+				ResetCounter: player.ResetCounter,
+				CarState:     carState,
+			})
+			if err != nil {
+				logger.Debug("Failed to encode car state", "player", player.ID, "err", err)
+				continue
+			}
+			b.encoded[player.ID] = append(b.encoded[player.ID], data)
 		}
-		stateBytes = append(stateBytes, data)
 	}
 
-	// Combine all car states into one byte array
-	combined := combineByteSlices(stateBytes)
+	ids := make([]uint32, 0, len(b.encoded))
+	for id := range b.encoded {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for start := 0; start < len(ids); start += carsPerGroup {
+		group := ids[start:min(start+carsPerGroup, len(ids))]
+		for _, id := range group {
+			b.groupOf[id] = len(b.groups)
+		}
+		b.groups = append(b.groups, group)
+	}
+}
 
-	// Compress with zlib settings (level 9)
-	compressed, err := compressWithSettings(combined)
+// SendCarUpdates queues the states of this tick of the given cars
+func (b *CarUpdateBatcher) SendCarUpdates(player *Player, cars []*Player) error {
+	packets, err := b.batch(cars)
 	if err != nil {
-		return fmt.Errorf("failed to compress car states: %w", err)
+		return err
+	}
+	for _, packet := range packets {
+		if err := b.sendSinglePacket(player, packet.data); err != nil {
+			return err
+		}
+		carUpdateBatchSize.Observe(float64(packet.states))
+		carUpdateCompressedBytes.Add(float64(len(packet.data) - 5))
 	}
+	return nil
+}
 
-	// Check if compressed data fits in a single packet
-	if len(compressed) <= b.maxChunkSize {
-		// Send as one packet
-		return b.sendSinglePacket(player, compressed)
+// batch picks the packets with this tick's states of the given cars: the
+// packets of every group they fully cover and single car packets for the
+// rest
+func (b *CarUpdateBatcher) batch(cars []*Player) ([]carUpdatePacket, error) {
+	wanted := make(map[uint32]bool, len(cars))
+	perGroup := make(map[int]int)
+	for _, car := range cars {
+		if group, ok := b.groupOf[car.ID]; ok && !wanted[car.ID] {
+			wanted[car.ID] = true
+			perGroup[group]++
+		}
 	}
 
-	// Too big - split and try recursively
-	return b.splitAndSend(player, carStates)
+	var packets []carUpdatePacket
+	for index, group := range b.groups {
+		switch perGroup[index] {
+		case 0:
+		case len(group):
+			groupPackets, err := cachedPackets(b, b.groupPackets, index, group)
+			if err != nil {
+				return nil, err
+			}
+			packets = append(packets, groupPackets...)
+		default:
+			for _, id := range group {
+				if !wanted[id] {
+					continue
+				}
+				carPackets, err := cachedPackets(b, b.carPackets, id, []uint32{id})
+				if err != nil {
+					return nil, err
+				}
+				packets = append(packets, carPackets...)
+			}
+		}
+	}
+	return packets, nil
 }
 
-// sendSinglePacket sends one compressed batch with header
-func (b *CarUpdateBatcher) sendSinglePacket(player *Player, compressed []byte) error {
-	// Create packet: [type][sessionID (4 bytes)][compressed data]
-	packet := make([]byte, 5+len(compressed))
-
-	packet[0] = byte(gamepackets.PlayerCarUpdate)
-	binary.LittleEndian.PutUint32(packet[1:5], b.sessionID)
-	copy(packet[5:], compressed)
+// cachedPackets returns the packets under key, compressing the states of
+// the given cars the first time they're asked for this tick
+func cachedPackets[K comparable](b *CarUpdateBatcher, cache map[K][]carUpdatePacket, key K, ids []uint32) ([]carUpdatePacket, error) {
+	if packets, ok := cache[key]; ok {
+		carUpdateBatchesShared.Inc()
+		return packets, nil
+	}
 
-	return player.Session.UnreliableDC.Send(packet)
+	var states [][]byte
+	for _, id := range ids {
+		states = append(states, b.encoded[id]...)
+	}
+	packets, err := b.compress(states)
+	if err != nil {
+		return nil, err
+	}
+	cache[key] = packets
+	return packets, nil
 }
 
-// splitAndSend splits the car states and tries again recursively
-func (b *CarUpdateBatcher) splitAndSend(player *Player, carStates []*CarStateExtended) error {
-	if len(carStates) <= 1 {
-		return fmt.Errorf("cannot split car update data further - single item still too large")
+// compress builds the packets for the encoded states, splitting them in half
+// until every part fits in one packet
+func (b *CarUpdateBatcher) compress(states [][]byte) ([]carUpdatePacket, error) {
+	// Combine all car states into one byte array
+	combined := combineByteSlices(states)
+
+	compressed, err := b.compressData(combined)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress car states: %w", err)
 	}
 
-	// Split in half
-	mid := len(carStates) / 2
-	firstHalf := carStates[:mid]
-	secondHalf := carStates[mid:]
+	// Check if compressed data fits in a single packet
+	if len(compressed) <= b.maxChunkSize {
+		// Create packet: [type][sessionID (4 bytes)][compressed data]
+		packet := make([]byte, 5+len(compressed))
+		packet[0] = byte(gamepackets.PlayerCarUpdate)
+		binary.LittleEndian.PutUint32(packet[1:5], b.sessionID)
+		copy(packet[5:], compressed)
+		return []carUpdatePacket{{data: packet, states: len(states)}}, nil
+	}
 
-	// Recursively try to send each half
-	if err := b.SendCarUpdates(player, firstHalf); err != nil {
-		return fmt.Errorf("failed to send first half: %w", err)
+	if len(states) <= 1 {
+		return nil, fmt.Errorf("cannot split car update data further - single item still too large")
 	}
 
-	if err := b.SendCarUpdates(player, secondHalf); err != nil {
-		return fmt.Errorf("failed to send second half: %w", err)
+	// Too big - split in half and try recursively
+	mid := len(states) / 2
+	firstHalf, err := b.compress(states[:mid])
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress first half: %w", err)
 	}
+	secondHalf, err := b.compress(states[mid:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress second half: %w", err)
+	}
+	return append(firstHalf, secondHalf...), nil
+}
 
-	return nil
+// sendSinglePacket queues one finished packet. Players that get the same
+// cars share the packet, nothing may modify it.
+func (b *CarUpdateBatcher) sendSinglePacket(player *Player, packet []byte) error {
+	return player.out.send(player.out.unreliable, outboundPacket{kind: gamepackets.PlayerCarUpdate, data: packet})
 }
 
 // Helper functions
@@ -131,20 +255,25 @@ func combineByteSlices(slices [][]byte) []byte {
 	return result
 }
 
-func compressWithSettings(data []byte) ([]byte, error) {
+func (b *CarUpdateBatcher) compressData(data []byte) ([]byte, error) {
 	var buf bytes.Buffer
 
-	// Use BestCompression (level 9)
-	writer, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
-	if err != nil {
-		return nil, err
+	if b.writer == nil || b.writerLevel != b.level {
+		writer, err := zlib.NewWriterLevel(&buf, b.level)
+		if err != nil {
+			return nil, err
+		}
+		b.writer, b.writerLevel = writer, b.level
+	} else {
+		b.writer.Reset(&buf)
 	}
 
-	if _, err := writer.Write(data); err != nil {
-		writer.Close()
+	if _, err := b.writer.Write(data); err != nil {
+		b.writer = nil
 		return nil, err
 	}
-	if err := writer.Close(); err != nil {
+	if err := b.writer.Close(); err != nil {
+		b.writer = nil
 		return nil, err
 	}
 
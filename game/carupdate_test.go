@@ -0,0 +1,194 @@
+package game
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"math/rand"
+	"polyserver/config"
+	gamepackets "polyserver/game/packets"
+	"testing"
+)
+
+// randomPlayers makes players that each sent two car states since the
+// last car update, spread over a few hundred units of track
+func randomPlayers(count int) []*Player {
+	rng := rand.New(rand.NewSource(1))
+	players := make([]*Player, count)
+	for i := range players {
+		player := &Player{ID: uint32(i + 1), carsSent: make(map[uint32]uint64)}
+		x, z := rng.Float32()*400, rng.Float32()*400
+		for frame := range 2 {
+			state := gamepackets.CarState{
+				Frames:     uint32(1000 + frame),
+				SpeedKmh:   rng.Float32() * 300,
+				HasStarted: true,
+				Position:   gamepackets.Vector3{X: x + float32(frame), Y: rng.Float32(), Z: z},
+				Quaternion: gamepackets.Quaternion{X: rng.Float32(), Y: rng.Float32(), Z: rng.Float32(), W: rng.Float32()},
+				Steering:   rng.Float32()*2 - 1,
+			}
+			for wheel := range 4 {
+				state.WheelSuspensionLength[wheel] = rng.Float32()
+				state.WheelSuspensionVelocity[wheel] = rng.Float32()
+				state.WheelDeltaRotation[wheel] = rng.Float32()
+				state.WheelSkidInfo[wheel] = rng.Float32()
+			}
+			player.UnsentCarStates = append(player.UnsentCarStates, state)
+		}
+		player.LastCarState = &player.UnsentCarStates[1]
+		players[i] = player
+	}
+	return players
+}
+
+// decompress returns the encoded states in a car update packet
+func decompress(t *testing.T, packet carUpdatePacket) []byte {
+	t.Helper()
+	if packet.data[0] != byte(gamepackets.PlayerCarUpdate) {
+		t.Fatalf("packet type %d, want a car update", packet.data[0])
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(packet.data[5:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCarUpdateBatcherSplitsAtSizeLimit(t *testing.T) {
+	players := randomPlayers(carsPerGroup)
+	batcher := NewCarUpdateBatcher(1)
+	batcher.maxChunkSize = 400
+	batcher.StartTick(players, 6)
+
+	packets, err := batcher.batch(players)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) < 2 {
+		t.Fatalf("got %d packets, want the group split", len(packets))
+	}
+
+	var want, got []byte
+	for _, player := range players {
+		for _, state := range batcher.encoded[player.ID] {
+			want = append(want, state...)
+		}
+	}
+	states := 0
+	for _, packet := range packets {
+		if len(packet.data)-5 > batcher.maxChunkSize {
+			t.Errorf("packet of %d bytes is over the limit of %d", len(packet.data)-5, batcher.maxChunkSize)
+		}
+		states += packet.states
+		got = append(got, decompress(t, packet)...)
+	}
+	if states != 2*len(players) {
+		t.Errorf("packets carry %d states, want %d", states, 2*len(players))
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("packets don't carry the encoded states in order")
+	}
+
+	// A single state that doesn't fit can't be split any further
+	batcher.maxChunkSize = 10
+	batcher.StartTick(players, 6)
+	if _, err := batcher.batch(players[:1]); err == nil {
+		t.Error("no error for a state over the limit")
+	}
+}
+
+func TestCarUpdateBatcherSharesPackets(t *testing.T) {
+	players := randomPlayers(2*carsPerGroup + 3)
+	batcher := NewCarUpdateBatcher(1)
+	batcher.StartTick(players, 6)
+
+	// Everyone but one driver, the way drivers get cars
+	others := func(self *Player) []*Player {
+		var cars []*Player
+		for _, p := range players {
+			if p != self {
+				cars = append(cars, p)
+			}
+		}
+		return cars
+	}
+	batch := func(cars []*Player) map[*byte]bool {
+		packets, err := batcher.batch(cars)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shared := make(map[*byte]bool)
+		for _, packet := range packets {
+			shared[&packet.data[0]] = true
+		}
+		return shared
+	}
+
+	// Spectators with the same cars get the very same packets
+	spectatorA, spectatorB := batch(players), batch(players)
+	if len(spectatorA) != len(batcher.groups) {
+		t.Fatalf("spectator got %d packets, want one per group", len(spectatorA))
+	}
+	for packet := range spectatorA {
+		if !spectatorB[packet] {
+			t.Fatal("spectators with the same cars got different packets")
+		}
+	}
+
+	// Two drivers in the first group share the other groups' packets and
+	// the single car packets of the rest of their group
+	driverA, driverB := batch(others(players[0])), batch(others(players[1]))
+	if len(driverA) != carsPerGroup-1+len(batcher.groups)-1 {
+		t.Fatalf("driver got %d packets", len(driverA))
+	}
+	shared := 0
+	for packet := range driverA {
+		if driverB[packet] {
+			shared++
+		}
+		if spectatorA[packet] {
+			delete(spectatorA, packet)
+		}
+	}
+	if shared != len(driverA)-1 {
+		t.Errorf("drivers share %d of %d packets, want all but one", shared, len(driverA))
+	}
+	if len(spectatorA) != 1 {
+		t.Errorf("drivers didn't reuse the spectators' group packets")
+	}
+	if len(batcher.groupPackets) != len(batcher.groups) || len(batcher.carPackets) != carsPerGroup {
+		t.Errorf("compressed %d groups and %d single cars", len(batcher.groupPackets), len(batcher.carPackets))
+	}
+}
+
+// BenchmarkCarUpdateBatcher measures one car update for 200 players at
+// different compression levels, with every car sent to everyone and with
+// the default car cap
+func BenchmarkCarUpdateBatcher(b *testing.B) {
+	players := randomPlayers(200)
+	for _, maxCars := range []int{0, 64} {
+		for _, level := range []int{1, 6, 9} {
+			b.Run(fmt.Sprintf("players=200/maxCars=%d/level=%d", maxCars, level), func(b *testing.B) {
+				policy := config.Default().Network
+				policy.MaxCars = maxCars
+				server := &GameServer{players: players}
+				batcher := NewCarUpdateBatcher(1)
+
+				for b.Loop() {
+					server.carTick++
+					batcher.StartTick(players, level)
+					for _, player := range players {
+						if _, err := batcher.batch(server.relevantCars(player, policy)); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
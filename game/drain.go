@@ -0,0 +1,58 @@
+package game
+
+import (
+	"polyserver/events"
+	"slices"
+)
+
+//
+// DRAIN
+//
+
+type DrainEvent struct {
+	Notice  string `json:"notice"`
+	Players int    `json:"players"`
+}
+
+// Drain stops accepting players and ends the running session, which archives
+// its results. Players stay connected until DisconnectAll so they get the
+// end of session first.
+func (server *GameServer) Drain(notice string) {
+	if server.draining.Swap(true) {
+		return
+	}
+	server.SignalingServer.StopAccepting()
+
+	players := server.PlayerCount()
+
+	logger.Info("Draining server", "players", players, "notice", notice)
+	// The game has no chat packet, the notice only goes to the event stream
+	server.Events.Publish(events.Drain, DrainEvent{
+		Notice:  notice,
+		Players: players,
+	})
+
+	if err := server.EndSession(); err != nil {
+		// Already between sessions, the last one was archived when it ended
+		logger.Debug("No session to end", "err", err)
+	}
+}
+
+func (server *GameServer) Draining() bool {
+	return server.draining.Load()
+}
+
+// DisconnectAll closes the connection of every player
+func (server *GameServer) DisconnectAll() {
+	// Closing a peer ends up in onPlayerDisconnect on the game loop, so the
+	// peers are closed outside of it
+	var players []*Player
+	server.do(func() { players = slices.Clone(server.players) })
+
+	for _, player := range players {
+		if err := player.Session.Peer.Close(); err != nil {
+			logger.Warn("Failed to close player connection", "player", player.ID, "err", err)
+		}
+	}
+	logger.Info("Disconnected players", "count", len(players))
+}
@@ -0,0 +1,52 @@
+package game
+
+import "polyserver/events"
+
+// Payloads of the events published on GameServer.Events
+
+type PlayerEvent struct {
+	ID          uint32  `json:"id"`
+	Nickname    string  `json:"nickname"`
+	CountryCode *string `json:"countryCode,omitempty"`
+	Kicked      bool    `json:"kicked,omitempty"`
+	Reason      string  `json:"reason,omitempty"` // why they were kicked
+}
+
+type RecordEvent struct {
+	ID        uint32 `json:"id"`
+	Nickname  string `json:"nickname"`
+	SessionID uint32 `json:"sessionId"`
+	Frames    uint32 `json:"frames"`
+}
+
+type ResetEvent struct {
+	ID           uint32 `json:"id"`
+	Nickname     string `json:"nickname"`
+	ResetCounter uint32 `json:"resetCounter"`
+}
+
+type PingEvent struct {
+	ID   uint32 `json:"id"`
+	Ping int    `json:"ping"`
+}
+
+type SessionEvent struct {
+	SessionID        uint32   `json:"sessionId"`
+	GameMode         GameMode `json:"gamemode"`
+	SwitchingSession bool     `json:"switchingSession"`
+	MaxPlayers       int      `json:"maxPlayers"`
+	Track            string   `json:"track"`
+}
+
+func (s *GameServer) publishSession() {
+	event := SessionEvent{
+		SessionID:        s.session.SessionID,
+		GameMode:         s.session.GameMode,
+		SwitchingSession: s.session.SwitchingSession,
+		MaxPlayers:       s.session.MaxPlayers,
+	}
+	if s.session.CurrentTrack != nil {
+		event.Track = s.session.CurrentTrack.Metadata.Name
+	}
+	s.Events.Publish(events.Session, event)
+}
@@ -0,0 +1,137 @@
+package game
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"polyserver/config"
+	gamepackets "polyserver/game/packets"
+	"slices"
+)
+
+//
+// INTEREST MANAGEMENT
+//
+
+var errPlayerNotFound = errors.New("player not found")
+
+// relevantCars picks the players whose new car states go to player this car
+// update. Distances are measured from the car the player watches; a car is
+// due every update within network.nearDistance, every network.midInterval
+// updates within network.farDistance and every network.farInterval updates
+// beyond it. When more than network.maxCars are due the most overdue ones
+// win, then the closest, so far cars still get through in a crowd. The
+// spectated car is always sent.
+func (server *GameServer) relevantCars(player *Player, policy config.NetworkConfig) []*Player {
+	origin := player.LastCarState
+	if target := server.playerByID(player.spectating); target != nil {
+		origin = target.LastCarState
+	}
+
+	type candidate struct {
+		player   *Player
+		distance float64
+		overdue  float64
+	}
+
+	var cars []*Player
+	var due []candidate
+	for _, p := range server.players {
+		if p == player || len(p.UnsentCarStates) == 0 {
+			continue
+		}
+		if p.ID == player.spectating {
+			cars = append(cars, p)
+			continue
+		}
+
+		// Without a position to compare every car counts as near
+		distance := 0.0
+		if origin != nil && p.LastCarState != nil {
+			distance = carDistance(origin.Position, p.LastCarState.Position)
+		}
+		interval := policy.FarInterval
+		switch {
+		case distance <= policy.NearDistance:
+			interval = 1
+		case distance <= policy.FarDistance:
+			interval = policy.MidInterval
+		}
+
+		waited := server.carTick - player.carsSent[p.ID]
+		if waited < uint64(interval) {
+			carStatesFiltered.Add(float64(len(p.UnsentCarStates)))
+			continue
+		}
+		due = append(due, candidate{
+			player:   p,
+			distance: distance,
+			overdue:  float64(waited) / float64(interval),
+		})
+	}
+
+	if policy.MaxCars > 0 && len(cars)+len(due) > policy.MaxCars {
+		slices.SortFunc(due, func(a, b candidate) int {
+			if c := cmp.Compare(b.overdue, a.overdue); c != 0 {
+				return c
+			}
+			return cmp.Compare(a.distance, b.distance)
+		})
+		keep := max(policy.MaxCars-len(cars), 0)
+		for _, c := range due[keep:] {
+			carStatesFiltered.Add(float64(len(c.player.UnsentCarStates)))
+		}
+		due = due[:keep]
+	}
+
+	for _, c := range due {
+		cars = append(cars, c.player)
+	}
+	for _, p := range cars {
+		player.carsSent[p.ID] = server.carTick
+	}
+	return cars
+}
+
+func carDistance(a, b gamepackets.Vector3) float64 {
+	dx := float64(a.X - b.X)
+	dy := float64(a.Y - b.Y)
+	dz := float64(a.Z - b.Z)
+	return math.Sqrt(dx*dx + dy*dy + dz*dz)
+}
+
+func (server *GameServer) playerByID(id uint32) *Player {
+	if id == 0 {
+		return nil
+	}
+	for _, player := range server.players {
+		if player.ID == id {
+			return player
+		}
+	}
+	return nil
+}
+
+// Spectate makes player id watch target's car: it's always sent to them and
+// the other cars are filtered by their distance to it. A target of 0 or the
+// player itself goes back to their own car.
+func (server *GameServer) Spectate(id, target uint32) error {
+	var err error
+	server.do(func() {
+		player := server.playerByID(id)
+		if player == nil {
+			err = errPlayerNotFound
+			return
+		}
+		if target == id {
+			target = 0
+		}
+		if target != 0 && server.playerByID(target) == nil {
+			err = errPlayerNotFound
+			return
+		}
+		player.spectating = target
+		logger.Info("Spectate target changed", "player", id, "nickname", player.Nickname, "target", target)
+	})
+	return err
+}
@@ -0,0 +1,69 @@
+package game
+
+import (
+	"fmt"
+	"polyserver/config"
+	"time"
+)
+
+//
+// KICK POLICY
+//
+
+// enforceKickPolicy kicks the players whose connection breaks the network.*
+// limits, it runs after every round of pings
+func (server *GameServer) enforceKickPolicy() {
+	policy := config.Current().Network
+	now := time.Now()
+
+	// Car updates are only expected while a session runs
+	var idleFrom time.Time
+	sessionStart, running := server.recorder.startedAt()
+	if running && !server.session.SwitchingSession {
+		idleFrom = sessionStart
+	}
+
+	for _, player := range server.players {
+		if player.IsKicked {
+			continue
+		}
+		name, reason := player.checkKickPolicy(policy, now, idleFrom)
+		if name == "" {
+			continue
+		}
+		policyKicks.With(name).Inc()
+		server.kick(player, reason)
+	}
+}
+
+// checkKickPolicy returns the policy the player breaks and why, or empty
+// strings. idleFrom is zero when no car updates are expected.
+func (player *Player) checkKickPolicy(policy config.NetworkConfig, now, idleFrom time.Time) (string, string) {
+	missed := player.pings.missed
+	if policy.MaxPing > 0 && player.Ping > policy.MaxPing && missed == 0 {
+		if player.highPingSince.IsZero() {
+			player.highPingSince = now
+		}
+	} else {
+		player.highPingSince = time.Time{}
+	}
+	highPingSince, ping := player.highPingSince, player.Ping
+
+	if policy.MaxMissedPongs > 0 && missed >= policy.MaxMissedPongs {
+		return "missedPongs", fmt.Sprintf("%d pings in a row went unanswered", missed)
+	}
+	if !highPingSince.IsZero() && now.Sub(highPingSince) >= time.Duration(policy.MaxPingWindow) {
+		return "maxPing", fmt.Sprintf("ping %dms stayed above %dms for %s", ping, policy.MaxPing, now.Sub(highPingSince).Round(time.Second))
+	}
+
+	if policy.IdleTimeout > 0 && !idleFrom.IsZero() {
+		lastUpdate := player.lastCarUpdate
+		if lastUpdate.Before(idleFrom) {
+			lastUpdate = idleFrom
+		}
+		if idle := now.Sub(lastUpdate); idle >= time.Duration(policy.IdleTimeout) {
+			return "idle", fmt.Sprintf("no car update for %s", idle.Round(time.Second))
+		}
+	}
+	return "", ""
+}
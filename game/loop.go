@@ -0,0 +1,87 @@
+package game
+
+import (
+	"polyserver/config"
+	"time"
+)
+
+//
+// GAME LOOP
+//
+
+// The game loop is the only goroutine that touches the players, the session
+// and the race state of each player, so none of it needs a lock. Signaling
+// callbacks, packets from the data channels and API calls hand it work
+// through do and post, and its timers fire on the loop itself. Packets to
+// players are only queued here, every player has a writer goroutine that
+// sends them (see outbound.go).
+
+func (server *GameServer) run() {
+	defer close(server.done)
+
+	timing := config.Current().Timing
+	standings := time.NewTicker(time.Duration(timing.StandingsInterval))
+	stateSaves := time.NewTicker(time.Duration(timing.StateSaveInterval))
+	defer standings.Stop()
+	defer stateSaves.Stop()
+	defer server.ticks.stop()
+
+	for {
+		select {
+		case <-server.stop:
+			// Stop the writers of players that are still around, whatever
+			// they still have queued is dropped
+			for _, player := range server.players {
+				player.out.close()
+			}
+			return
+		case f := <-server.actions:
+			f()
+		case <-server.ticks.pings.C:
+			server.sendPings()
+		case <-server.ticks.carUpdates.C:
+			behind := server.playersBehind()
+			start := time.Now()
+			server.updateCarStates()
+			server.adaptTickRates(time.Since(start), behind)
+		case <-standings.C:
+			server.publishStandings()
+		case <-stateSaves.C:
+			server.saveStateIfChanged()
+		}
+	}
+}
+
+// do runs f on the game loop and waits for it to finish. Calling it from the
+// loop itself deadlocks, code on the loop calls the unexported methods. Once
+// the loop stopped f is skipped.
+func (server *GameServer) do(f func()) {
+	done := make(chan struct{})
+	select {
+	case server.actions <- func() {
+		defer close(done)
+		f()
+	}:
+	case <-server.done:
+		return
+	}
+	select {
+	case <-done:
+	case <-server.done:
+	}
+}
+
+// post queues f on the game loop without waiting for it
+func (server *GameServer) post(f func()) {
+	select {
+	case server.actions <- f:
+	case <-server.done:
+	}
+}
+
+// Stop ends the game loop and its timers. Players should be disconnected
+// first, anything that needs the loop does nothing afterwards.
+func (server *GameServer) Stop() {
+	server.stopOnce.Do(func() { close(server.stop) })
+	<-server.done
+}
@@ -0,0 +1,197 @@
+package game
+
+import (
+	"fmt"
+	"polyserver/config"
+	gamepackets "polyserver/game/packets"
+	"polyserver/signaling"
+	"polyserver/tracks"
+	webrtc_session "polyserver/webrtc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// newTestPeer makes a peer session with the game's data channels. It's never
+// connected, so whatever the writers send fails and is counted.
+func newTestPeer(t *testing.T, sessionID string) *webrtc_session.PeerSession {
+	t.Helper()
+	peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	negotiated := true
+	reliableID, unreliableID := uint16(0), uint16(1)
+	reliable, err := peer.CreateDataChannel("reliable", &webrtc.DataChannelInit{Negotiated: &negotiated, ID: &reliableID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreliable, err := peer.CreateDataChannel("unreliable", &webrtc.DataChannelInit{Negotiated: &negotiated, ID: &unreliableID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &webrtc_session.PeerSession{SessionID: sessionID, Peer: peer, ReliableDC: reliable, UnreliableDC: unreliable}
+}
+
+// newTestServer starts a game loop with a running session on fast tickers
+func newTestServer(t *testing.T) (*GameServer, *signaling.WebRTCServer) {
+	t.Helper()
+	signalingServer := signaling.NewServer(signaling.NewLoopback(), nil)
+	server := NewServer(signalingServer)
+	t.Cleanup(server.Stop)
+
+	server.UpdateGameSession(GameSession{
+		GameMode:          Competitive,
+		SwitchingSession:  true,
+		CurrentTrack:      tracks.LoadTrack("../tracks/official/desert1.track"),
+		MaxPlayers:        50,
+		CarUpdateInterval: config.Duration(10 * time.Millisecond),
+		PingInterval:      config.Duration(100 * time.Millisecond),
+	})
+	if err := server.StartSession(); err != nil {
+		t.Fatal(err)
+	}
+	return server, signalingServer
+}
+
+// TestGameLoopConcurrency joins, drives and drops players while the session
+// changes and the API reads the game, everything from its own goroutine the
+// way signaling, data channels and HTTP handlers do. Run it with -race.
+func TestGameLoopConcurrency(t *testing.T) {
+	server, signalingServer := newTestServer(t)
+	const players = 16
+
+	peers := make([]*webrtc_session.PeerSession, players)
+	for i := range peers {
+		peers[i] = newTestPeer(t, fmt.Sprintf("session-%d", i))
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	repeat := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				f(i)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	// Joins and disconnects come from signaling
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, peer := range peers {
+			signalingServer.OnOpen(uint32(i+1), signaling.JoinInvite{Session: peer.SessionID, Nickname: fmt.Sprintf("player%d", i)}, peer)
+			if i%4 == 3 {
+				signalingServer.OnClose(peers[i-1].SessionID)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	// Packets are decoded on the data channels' goroutines and posted
+	repeat(func(i int) {
+		var current []*Player
+		var sessionID uint32
+		server.do(func() {
+			current = append(current, server.players...)
+			sessionID = server.session.SessionID
+		})
+		for _, player := range current {
+			state := &gamepackets.CarState{
+				Frames:              uint32(i),
+				HasStarted:          true,
+				NextCheckpointIndex: uint16(i / 50),
+				Position:            gamepackets.Vector3{X: float32(player.ID * 10), Z: float32(i)},
+			}
+			var packet gamepackets.HostPacket = gamepackets.HostCarUpdatePacket{SessionID: sessionID, CarState: state}
+			if i%100 == 99 {
+				packet = gamepackets.HostRecordPacket{SessionID: sessionID, NumOfFrames: uint32(i)}
+			}
+			server.post(func() { player.HandlePacket(packet) })
+		}
+	})
+
+	// The control API changes the session
+	track := tracks.LoadTrack("../tracks/official/desert2.track")
+	repeat(func(i int) {
+		switch i % 4 {
+		case 0:
+			server.EndSession()
+		case 1:
+			session := server.Session()
+			session.CurrentTrack = track
+			session.SwitchingSession = true
+			server.UpdateGameSession(session)
+		case 2:
+			server.StartSession()
+		case 3:
+			server.SetTrack(track)
+		}
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	// And reads it
+	repeat(func(i int) {
+		server.Players()
+		server.Standings()
+		server.Session()
+		server.PlayerCount()
+		server.TickRates()
+		server.ICEDiagnostics()
+		server.PlayerNetStats(uint32(i%players + 1))
+		server.Spectate(uint32(i%players+1), uint32((i+1)%players+1))
+		if i%50 == 49 {
+			server.KickPlayer(uint32(i%players + 1))
+		}
+	})
+
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	for _, peer := range peers {
+		signalingServer.OnClose(peer.SessionID)
+	}
+	if count := server.PlayerCount(); count != 0 {
+		t.Errorf("%d players left after everyone disconnected", count)
+	}
+}
+
+// After Stop, API calls return instead of waiting for the loop
+func TestGameLoopStop(t *testing.T) {
+	server, signalingServer := newTestServer(t)
+	for i := range 4 {
+		peer := newTestPeer(t, fmt.Sprintf("session-%d", i))
+		signalingServer.OnOpen(uint32(i+1), signaling.JoinInvite{Session: peer.SessionID}, peer)
+	}
+	if count := server.PlayerCount(); count != 4 {
+		t.Fatalf("%d players joined, want 4", count)
+	}
+
+	server.Stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.Players()
+		server.EndSession()
+		signalingServer.OnClose("session-0")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("API calls block after Stop")
+	}
+}
@@ -2,22 +2,43 @@ package game
 
 import (
 	"fmt"
-	"log"
 
+	"polyserver/config"
+	"polyserver/events"
 	gamepackets "polyserver/game/packets"
+	gametrack "polyserver/game/track"
+	"polyserver/logging"
 	"polyserver/signaling"
 	webrtc_session "polyserver/webrtc"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var logger = logging.For("game")
+
+// GameServer runs the game. The players and the session belong to the game
+// loop, see loop.go; other goroutines go through the exported methods.
 type GameServer struct {
 	SignalingServer *signaling.WebRTCServer
-	Players         []*Player
-	playersLock     sync.Mutex
+	players         []*Player
 	Factory         gamepackets.PacketFactory
-	GameSession     *GameSession
+	session         *GameSession
 	Batcher         *CarUpdateBatcher
+	Archive         *SessionArchive
+	Events          *events.Bus
+	StateStore      *StateStore
+	recorder        sessionRecorder
+	records         recentRecords
+	actions         chan func()
+	ticks           *ticks
+	stop            chan struct{}
+	stopOnce        sync.Once
+	done            chan struct{}
+	carTick         uint64
+	standingsDirty  atomic.Bool
+	draining        atomic.Bool
+	stateDirty      atomic.Bool
 }
 
 type GameMode uint8
@@ -41,54 +62,240 @@ func (gm GameMode) String() string {
 func NewServer(signalingServer *signaling.WebRTCServer) *GameServer {
 	server := &GameServer{
 		SignalingServer: signalingServer,
-		Players:         make([]*Player, 0),
+		players:         make([]*Player, 0),
 		Factory:         gamepackets.PacketFactory{},
-		GameSession:     &GameSession{},
+		session:         &GameSession{},
+		Events:          events.NewBus(),
+		actions:         make(chan func(), 256),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
 	}
+	server.ticks = newTicks(server.tickIntervals())
 
-	signalingServer.OnOpen = server.onPlayerJoin
-	signalingServer.OnClose = server.onPlayerDisconnect
-
-	schedule(server.sendPings, time.Second)
+	signalingServer.OnOpen = func(id uint32, p signaling.JoinInvite, session *webrtc_session.PeerSession) {
+		server.post(func() { server.onPlayerJoin(id, p, session) })
+	}
+	signalingServer.OnClose = func(sessionId string) {
+		server.post(func() { server.onPlayerDisconnect(sessionId) })
+	}
 
-	server.Batcher = NewCarUpdateBatcher(server.GameSession.SessionID)
+	server.Batcher = NewCarUpdateBatcher(server.session.SessionID)
 
-	schedule(server.UpdateCarStates, 100*time.Millisecond)
+	go server.run()
+	go server.collectChannelStats()
 
 	return server
 }
 
+// Session returns a copy of the current session
+func (s *GameServer) Session() GameSession {
+	var session GameSession
+	s.do(func() { session = *s.session })
+	return session
+}
+
 func (s *GameServer) UpdateGameSession(gs GameSession) {
-	s.GameSession.SessionID++
-	s.GameSession.GameMode = gs.GameMode
-	s.GameSession.SwitchingSession = gs.SwitchingSession
-	s.GameSession.CurrentTrack = gs.CurrentTrack
-	s.GameSession.MaxPlayers = gs.MaxPlayers
-	s.Batcher.sessionID = s.GameSession.SessionID
-	for _, player := range s.Players {
+	s.do(func() { s.updateGameSession(gs) })
+}
+
+func (s *GameServer) updateGameSession(gs GameSession) {
+	s.archiveSession()
+	s.session.SessionID++
+	s.session.GameMode = gs.GameMode
+	s.session.SwitchingSession = gs.SwitchingSession
+	s.session.CurrentTrack = gs.CurrentTrack
+	s.session.MaxPlayers = gs.MaxPlayers
+	s.session.CarUpdateInterval = gs.CarUpdateInterval
+	s.session.PingInterval = gs.PingInterval
+	s.ticks.retime(s.tickIntervals())
+	s.Batcher.sessionID = s.session.SessionID
+	currentSession.Set(float64(s.session.SessionID))
+	for _, player := range s.players {
+		// Records belong to the session they were driven in
+		player.NumberOfFrames = nil
+		player.LastCarState = nil
+		player.Progress = raceProgress{}
 		player.SendTrack()
 	}
+	s.standingsDirty.Store(true)
+	if !s.session.SwitchingSession {
+		s.startRecording()
+	}
+	s.publishSession()
+	s.saveState()
+}
+
+// SetTrack changes the track of the current session in place, like the
+// legacy /track route always did. Only players joining afterwards are sent
+// the new track.
+func (s *GameServer) SetTrack(track *gametrack.Track) {
+	s.do(func() {
+		s.session.CurrentTrack = track
+		s.publishSession()
+		s.stateDirty.Store(true)
+	})
+}
+
+// EndSession stops the running session and sends every player back to the lobby
+func (s *GameServer) EndSession() error {
+	var err error
+	s.do(func() { err = s.endSession() })
+	return err
+}
+
+func (s *GameServer) endSession() error {
+	if s.session.SwitchingSession {
+		return fmt.Errorf("session already ended")
+	}
+	s.session.SwitchingSession = true
+	s.archiveSession()
+	s.publishSession()
+	s.saveState()
+	for _, player := range s.players {
+		player.Send(gamepackets.EndSessionPacket{})
+	}
+	return nil
+}
+
+// FinishTimes returns the best recorded frame count of everyone who set a
+// time in the given session, keyed by nickname. Players who left count too:
+// the running session is read from its recorder, an ended one from the
+// archive.
+func (s *GameServer) FinishTimes(sessionID uint32) (map[string]uint32, error) {
+	summary := s.recorder.snapshot()
+	if summary == nil || summary.SessionID != sessionID {
+		if s.Archive == nil {
+			return nil, fmt.Errorf("session %d is neither running nor archived", sessionID)
+		}
+		var err error
+		if summary, err = s.Archive.Get(sessionID); err != nil {
+			return nil, fmt.Errorf("session %d is neither running nor archived: %w", sessionID, err)
+		}
+	}
+
+	times := make(map[string]uint32)
+	for _, p := range summary.Participants {
+		if p.FinishFrames == nil {
+			continue
+		}
+		// Players who rejoined show up once per connection
+		if best, ok := times[p.Nickname]; !ok || *p.FinishFrames < best {
+			times[p.Nickname] = *p.FinishFrames
+		}
+	}
+	return times, nil
+}
+
+// StartSession starts the session that was set up while switching
+func (s *GameServer) StartSession() error {
+	var err error
+	s.do(func() {
+		if !s.session.SwitchingSession {
+			err = fmt.Errorf("session already started")
+			return
+		}
+		s.session.SwitchingSession = false
+		s.startRecording()
+		s.publishSession()
+		s.saveState()
+		for _, player := range s.players {
+			player.StartNewSession()
+		}
+	})
+	return err
+}
+
+//
+// SESSION ARCHIVE
+//
+
+func (s *GameServer) startRecording() {
+	sessionsStarted.Inc()
+	s.recorder.start(s.session)
+	for _, player := range s.players {
+		s.recorder.join(player)
+	}
+}
+
+// archiveSession snapshots the running session, if any, into the archive
+func (s *GameServer) archiveSession() {
+	summary := s.recorder.finish()
+	if summary == nil || s.Archive == nil {
+		return
+	}
+	if err := s.Archive.Save(summary); err != nil {
+		logger.Error("Failed to archive session", "session", summary.SessionID, "err", err)
+		return
+	}
+	logger.Info("Archived session", "session", summary.SessionID, "participants", len(summary.Participants))
+}
+
+//
+// PLAYERS
+//
+
+// PlayerSnapshot is a copy of what the API shows about a player
+type PlayerSnapshot struct {
+	ID           uint32
+	Nickname     string
+	CountryCode  *string
+	Frames       *uint32
+	Ping         int
+	ResetCounter uint32
+	Spectating   uint32
+}
+
+// Players returns a copy of every connected player
+func (server *GameServer) Players() []PlayerSnapshot {
+	var players []PlayerSnapshot
+	server.do(func() {
+		players = make([]PlayerSnapshot, 0, len(server.players))
+		for _, p := range server.players {
+			players = append(players, PlayerSnapshot{
+				ID:           p.ID,
+				Nickname:     p.Nickname,
+				CountryCode:  p.CountryCode,
+				Frames:       p.NumberOfFrames,
+				Ping:         p.Ping,
+				ResetCounter: p.ResetCounter,
+				Spectating:   p.spectating,
+			})
+		}
+	})
+	return players
+}
+
+func (server *GameServer) PlayerCount() int {
+	var count int
+	server.do(func() { count = len(server.players) })
+	return count
 }
 
 //
 // PLAYER JOIN
 //
 
-func (server *GameServer) onPlayerJoin(p signaling.JoinInvite, session *webrtc_session.PeerSession) {
+func (server *GameServer) onPlayerJoin(id uint32, p signaling.JoinInvite, session *webrtc_session.PeerSession) {
+
+	if server.draining.Load() {
+		logger.Info("Refusing player while draining", "nickname", p.Nickname)
+		go session.Peer.Close()
+		return
+	}
 
-	log.Println("Creating player " + p.Nickname)
+	logger.Info("Creating player", "nickname", p.Nickname)
 
 	carStyle, err := gamepackets.FromBase64String(p.CarStyle)
 	if err != nil {
 		carStyle = gamepackets.DefaultCarStyle()
-		log.Println("Failed fromBase64String:", err)
+		logger.Warn("Invalid car style, using default", "nickname", p.Nickname, "err", err)
 	}
 
 	newPlayer := NewPlayer(&Player{
 		Server:                  server,
 		Session:                 session,
 		IsKicked:                false,
-		ID:                      server.SignalingServer.ClientCount - 1,
+		ID:                      id,
 		Mods:                    p.Mods,
 		IsModsVanillaCompatible: p.IsModsVanillaCompatible,
 		Nickname:                p.Nickname,
@@ -100,27 +307,40 @@ func (server *GameServer) onPlayerJoin(p signaling.JoinInvite, session *webrtc_s
 		PingIdCounter:           0,
 		PingPackages:            make([]PingPackage, 0),
 		UnsentCarStates:         make([]gamepackets.CarState, 0),
+		lastCarUpdate:           time.Now(),
+		carsSent:                make(map[uint32]uint64),
 	})
 
 	newPlayer.Send(gamepackets.EndSessionPacket{})
 	newPlayer.SendTrack()
 	newPlayer.StartNewSession()
-	if server.GameSession.SwitchingSession {
+	if server.session.SwitchingSession {
 		newPlayer.Send(gamepackets.EndSessionPacket{})
 	}
 
 	// Send existing players to the new player
-	server.playersLock.Lock()
-	for _, player := range server.Players {
+	for _, player := range server.players {
 		newPlayer.SendPlayerUpdate(player)
 	}
-	server.playersLock.Unlock()
 
 	server.propagateUpdate(newPlayer)
 
-	server.playersLock.Lock()
-	server.Players = append(server.Players, newPlayer)
-	server.playersLock.Unlock()
+	server.players = append(server.players, newPlayer)
+	playersConnected.Inc()
+	playerJoins.Inc()
+
+	// Only the running summary is saved, lobby joins don't change the state
+	if !server.session.SwitchingSession {
+		server.recorder.join(newPlayer)
+		server.stateDirty.Store(true)
+	}
+
+	server.Events.Publish(events.PlayerJoin, PlayerEvent{
+		ID:          newPlayer.ID,
+		Nickname:    newPlayer.Nickname,
+		CountryCode: newPlayer.CountryCode,
+	})
+	server.standingsDirty.Store(true)
 }
 
 //
@@ -128,29 +348,44 @@ func (server *GameServer) onPlayerJoin(p signaling.JoinInvite, session *webrtc_s
 //
 
 func (server *GameServer) onPlayerDisconnect(sessionId string) {
-	server.playersLock.Lock()
-	defer server.playersLock.Unlock()
-
 	var playerId uint32
 	index := -1
 
-	for i, player := range server.Players {
+	for i, player := range server.players {
 		if player.Session.SessionID == sessionId {
-			log.Println("Removing player " + player.Nickname)
+			logger.Info("Removing player", "player", player.ID, "nickname", player.Nickname)
 			playerId = player.ID
 			index = i
 			break
 		}
 	}
 
-	if index >= 0 {
-		server.Players = append(server.Players[:index], server.Players[index+1:]...)
+	// Peers that never made it into the game, e.g. refused while draining
+	if index < 0 {
+		return
 	}
 
-	for _, player := range server.Players {
-		if player.ID == playerId {
-			continue
+	player := server.players[index]
+	server.players = append(server.players[:index], server.players[index+1:]...)
+	player.out.close()
+	for _, p := range server.players {
+		delete(p.carsSent, player.ID)
+		if p.spectating == player.ID {
+			p.spectating = 0
 		}
+	}
+	playersConnected.Dec()
+	playerLeaves.Inc()
+	deleteNetMetrics(player)
+	server.Events.Publish(events.PlayerLeave, PlayerEvent{
+		ID:       player.ID,
+		Nickname: player.Nickname,
+		Kicked:   player.IsKicked,
+		Reason:   player.KickReason,
+	})
+	server.standingsDirty.Store(true)
+
+	for _, player := range server.players {
 		player.Send(gamepackets.RemovePlayerPacket{
 			ID:       playerId,
 			IsKicked: false,
@@ -159,17 +394,41 @@ func (server *GameServer) onPlayerDisconnect(sessionId string) {
 }
 
 //
-// SCHEDULER
+// KICK
 //
 
-func schedule(f func(), interval time.Duration) *time.Ticker {
-	ticker := time.NewTicker(interval)
-	go func() {
-		for range ticker.C {
-			f()
+// KickPlayer kicks the player with the given ID and closes their connection
+// shortly after so the kick packet can still arrive. It reports whether the
+// player was found.
+func (server *GameServer) KickPlayer(id uint32) bool {
+	found := false
+	server.do(func() {
+		for _, player := range server.players {
+			if player.ID == id {
+				server.kick(player, "kicked from the control API")
+				found = true
+				return
+			}
 		}
-	}()
-	return ticker
+	})
+	return found
+}
+
+func (server *GameServer) kick(player *Player, reason string) {
+	logger.Info("Kicked player", "player", player.ID, "nickname", player.Nickname, "reason", reason)
+	playerKicks.Inc()
+	player.IsKicked = true
+	player.KickReason = reason
+	player.Send(gamepackets.KickPlayerPacket{})
+	for _, p := range server.players {
+		p.Send(gamepackets.RemovePlayerPacket{
+			ID:       player.ID,
+			IsKicked: true,
+		})
+	}
+	time.AfterFunc(1*time.Second, func() {
+		player.Session.Peer.Close()
+	})
 }
 
 //
@@ -177,19 +436,26 @@ func schedule(f func(), interval time.Duration) *time.Ticker {
 //
 
 func (server *GameServer) sendPings() {
-	server.playersLock.Lock()
-	for _, player := range server.Players {
+	for _, player := range server.players {
 		player.SendPing()
 	}
-	server.playersLock.Unlock()
 
 	server.sendPingDatas()
+
+	pings := make([]PingEvent, 0, len(server.players))
+	for _, player := range server.players {
+		pings = append(pings, PingEvent{ID: player.ID, Ping: player.Ping})
+	}
+	server.Events.Publish(events.Pings, pings)
+
+	server.updateNetMetrics()
+	server.enforceKickPolicy()
 }
 
 func (server *GameServer) sendPingDatas() {
 	pings := server.getPlayerPings()
 
-	for _, player := range server.Players {
+	for _, player := range server.players {
 		player.SendUnreliable(gamepackets.PingDataPacket{
 			HostID:      0,
 			PlayerPings: pings,
@@ -199,9 +465,9 @@ func (server *GameServer) sendPingDatas() {
 
 func (server *GameServer) getPlayerPings() []gamepackets.PlayerPing {
 
-	pings := make([]gamepackets.PlayerPing, 0, len(server.Players))
+	pings := make([]gamepackets.PlayerPing, 0, len(server.players))
 
-	for _, player := range server.Players {
+	for _, player := range server.players {
 		pings = append(pings, gamepackets.PlayerPing{
 			PlayerID: player.ID,
 			Ping:     uint16(player.Ping),
@@ -216,10 +482,8 @@ func (server *GameServer) getPlayerPings() []gamepackets.PlayerPing {
 //
 
 func (server *GameServer) propagateUpdate(p *Player) {
-	server.playersLock.Lock()
-	defer server.playersLock.Unlock()
-	for _, player := range server.Players {
-		log.Printf("Sending player %s to %s", p.Nickname, player.Nickname)
+	for _, player := range server.players {
+		logger.Debug("Sending player update", "nickname", p.Nickname, "to", player.Nickname)
 		player.SendPlayerUpdate(p)
 	}
 }
@@ -234,28 +498,17 @@ type CarStateExtended struct {
 	CarState     gamepackets.CarState
 }
 
-func (server *GameServer) UpdateCarStates() {
-	server.playersLock.Lock()
-	defer server.playersLock.Unlock()
-	for _, player := range server.Players {
-		var unsentCarStates []*CarStateExtended
-		// So others can't modify data while we're reading it
-		player.CSLock.Lock()
-		for _, p := range server.Players {
-			if player != p && len(p.UnsentCarStates) > 0 {
-				for _, carState := range p.UnsentCarStates {
-					unsentCarStates = append(unsentCarStates, &CarStateExtended{
-						ID:           p.ID,
-						ResetCounter: p.ResetCounter,
-						CarState:     carState,
-					})
-				}
-			}
+func (server *GameServer) updateCarStates() {
+	policy := config.Current().Network
+	server.carTick++
+	server.Batcher.StartTick(server.players, policy.CompressionLevel)
+	for _, player := range server.players {
+		// The batch only gets queued, the player's writer sends it
+		if err := server.Batcher.SendCarUpdates(player, server.relevantCars(player, policy)); err != nil {
+			logger.Debug("Failed to send car updates", "player", player.ID, "err", err)
 		}
-
-		// I wana look into this more, i think it would be nice
-		// to have it multithreaded
-		go server.Batcher.SendCarUpdates(player, unsentCarStates)
-		player.CSLock.Unlock()
+	}
+	for _, player := range server.players {
+		player.UnsentCarStates = player.UnsentCarStates[:0]
 	}
 }
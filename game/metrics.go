@@ -0,0 +1,47 @@
+package game
+
+import (
+	"polyserver/metrics"
+	"strconv"
+)
+
+var (
+	playersConnected = metrics.NewGauge("polyserver_players_connected", "Number of players currently connected.")
+	playerJoins      = metrics.NewCounter("polyserver_player_joins_total", "Players that joined the server.")
+	playerLeaves     = metrics.NewCounter("polyserver_player_leaves_total", "Players that left the server.")
+	playerKicks      = metrics.NewCounter("polyserver_player_kicks_total", "Players that were kicked.")
+	policyKicks      = metrics.NewCounterVec("polyserver_policy_kicks_total", "Players kicked automatically by policy.", "policy")
+
+	packetsReceived = metrics.NewCounterVec("polyserver_packets_received_total", "Packets received from players by type.", "type")
+	packetsSent     = metrics.NewCounterVec("polyserver_packets_sent_total", "Packets sent to players by type.", "type")
+	decodeErrors    = metrics.NewCounter("polyserver_packet_decode_errors_total", "Packets from players that failed to decode.")
+	packetsDropped  = metrics.NewCounterVec("polyserver_packets_dropped_total", "Packets dropped because a player's outbound queue was full, by channel.", "channel")
+	sendErrors      = metrics.NewCounterVec("polyserver_send_errors_total", "Packets the data channel failed to send, by channel.", "channel")
+
+	carUpdateBatchSize = metrics.NewHistogram("polyserver_car_update_batch_size", "Car states per car update packet.",
+		[]float64{1, 2, 5, 10, 20, 50, 100, 200})
+	carUpdateCompressedBytes = metrics.NewCounter("polyserver_car_update_compressed_bytes_total", "Compressed car update bytes sent.")
+	carUpdateBatchesShared   = metrics.NewCounter("polyserver_car_update_batches_shared_total", "Compressed car update packets reused for another player in the same car update.")
+	carUpdateInterval        = metrics.NewGauge("polyserver_car_update_interval_seconds", "Current interval between car updates.")
+	carStatesFiltered        = metrics.NewCounter("polyserver_car_states_filtered_total", "Car states not sent to a player because the car was far away or over network.maxCars.")
+
+	playerPing = metrics.NewHistogramVec("polyserver_player_ping_milliseconds", "Round trip time measured by ping/pong.",
+		[]float64{10, 25, 50, 75, 100, 150, 200, 300, 500, 1000}, "player", "nickname")
+	playerJitter   = metrics.NewGaugeVec("polyserver_player_jitter_milliseconds", "Mean difference between consecutive round trips over the ping window.", "player", "nickname")
+	playerPongLoss = metrics.NewGaugeVec("polyserver_player_pong_loss_ratio", "Share of pings in the ping window that were never answered.", "player", "nickname")
+	pongsLost      = metrics.NewCounter("polyserver_pongs_lost_total", "Pings that were never answered.")
+
+	channelBuffered         = metrics.NewGaugeVec("polyserver_channel_buffered_bytes", "Bytes queued on a player's data channel.", "player", "nickname", "channel")
+	channelBytesSent        = metrics.NewGaugeVec("polyserver_channel_sent_bytes", "Bytes sent on a player's data channel.", "player", "nickname", "channel")
+	channelBytesReceived    = metrics.NewGaugeVec("polyserver_channel_received_bytes", "Bytes received on a player's data channel.", "player", "nickname", "channel")
+	channelMessagesSent     = metrics.NewGaugeVec("polyserver_channel_sent_messages", "Messages sent on a player's data channel.", "player", "nickname", "channel")
+	channelQueued           = metrics.NewGaugeVec("polyserver_channel_queued_bytes", "Bytes waiting in a player's outbound queue.", "player", "nickname", "channel")
+	channelMessagesReceived = metrics.NewGaugeVec("polyserver_channel_received_messages", "Messages received on a player's data channel.", "player", "nickname", "channel")
+
+	sessionsStarted = metrics.NewCounter("polyserver_sessions_total", "Sessions started.")
+	currentSession  = metrics.NewGauge("polyserver_session_id", "ID of the current session.")
+)
+
+func playerLabel(player *Player) string {
+	return strconv.FormatUint(uint64(player.ID), 10)
+}
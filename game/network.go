@@ -0,0 +1,244 @@
+package game
+
+import (
+	"polyserver/config"
+	webrtc_session "polyserver/webrtc"
+	"slices"
+	"time"
+)
+
+//
+// NETWORK
+//
+
+type PlayerICE struct {
+	ID       uint32                        `json:"id"`
+	Nickname string                        `json:"nickname"`
+	ICE      webrtc_session.ICEDiagnostics `json:"ice"`
+}
+
+// ICEDiagnostics reports how every player is connected
+func (server *GameServer) ICEDiagnostics() []PlayerICE {
+	var list []PlayerICE
+	server.do(func() {
+		list = make([]PlayerICE, 0, len(server.players))
+		for _, player := range server.players {
+			list = append(list, PlayerICE{
+				ID:       player.ID,
+				Nickname: player.Nickname,
+				ICE:      player.Session.Diagnostics(),
+			})
+		}
+	})
+	return list
+}
+
+func (server *GameServer) PlayerICEDiagnostics(id uint32) (PlayerICE, bool) {
+	for _, p := range server.ICEDiagnostics() {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return PlayerICE{}, false
+}
+
+type pingSample struct {
+	rtt  int // milliseconds
+	lost bool
+}
+
+// pingHistory keeps the outcome of the last network.pingWindow pings of a
+// player
+type pingHistory struct {
+	samples []pingSample
+	// Pings lost since the last pong
+	missed int
+}
+
+func (h *pingHistory) add(sample pingSample) {
+	h.samples = append(h.samples, sample)
+	if window := config.Current().Network.PingWindow; len(h.samples) > window {
+		h.samples = append(h.samples[:0], h.samples[len(h.samples)-window:]...)
+	}
+	if sample.lost {
+		h.missed++
+		pongsLost.Inc()
+	} else {
+		h.missed = 0
+	}
+}
+
+// RTTStats are in milliseconds, computed from the answered pings
+type RTTStats struct {
+	Min int     `json:"min"`
+	Avg float64 `json:"avg"`
+	Max int     `json:"max"`
+	// Mean difference between consecutive round trips
+	Jitter float64 `json:"jitter"`
+}
+
+func (h *pingHistory) stats() (rtt RTTStats, loss float64) {
+	answered, lost, sum, diffs := 0, 0, 0, 0
+	previous := -1
+	for _, s := range h.samples {
+		if s.lost {
+			lost++
+			continue
+		}
+		if answered == 0 || s.rtt < rtt.Min {
+			rtt.Min = s.rtt
+		}
+		rtt.Max = max(rtt.Max, s.rtt)
+		sum += s.rtt
+		if previous >= 0 {
+			diffs += abs(s.rtt - previous)
+		}
+		previous = s.rtt
+		answered++
+	}
+	if answered > 0 {
+		rtt.Avg = float64(sum) / float64(answered)
+	}
+	if answered > 1 {
+		rtt.Jitter = float64(diffs) / float64(answered-1)
+	}
+	if len(h.samples) > 0 {
+		loss = float64(lost) / float64(len(h.samples))
+	}
+	return rtt, loss
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+type PlayerNet struct {
+	ID       uint32 `json:"id"`
+	Nickname string `json:"nickname"`
+	// Last measured round trip in milliseconds
+	Ping int      `json:"ping"`
+	RTT  RTTStats `json:"rtt"`
+	// Pings the stats are computed from, and the share of them whose pong
+	// never came
+	Pings    int                           `json:"pings"`
+	PongLoss float64                       `json:"pongLoss"`
+	Channels []webrtc_session.ChannelStats `json:"channels"`
+	Queues   []QueueStats                  `json:"queues"`
+}
+
+// netStats returns the stats kept on the game loop, the channel counters
+// are read by the caller off the loop
+func (player *Player) netStats() PlayerNet {
+	rtt, loss := player.pings.stats()
+	net := PlayerNet{
+		ID:       player.ID,
+		Nickname: player.Nickname,
+		Ping:     player.Ping,
+		RTT:      rtt,
+		Pings:    len(player.pings.samples),
+		PongLoss: loss,
+	}
+	net.Queues = player.out.stats()
+	return net
+}
+
+func (server *GameServer) PlayerNetStats(id uint32) (PlayerNet, bool) {
+	var net PlayerNet
+	var session *webrtc_session.PeerSession
+	server.do(func() {
+		for _, player := range server.players {
+			if player.ID == id {
+				net, session = player.netStats(), player.Session
+				return
+			}
+		}
+	})
+	if session == nil {
+		return PlayerNet{}, false
+	}
+	net.Channels = session.ChannelStats()
+	return net, true
+}
+
+// updateNetMetrics exports the ping and queue stats of every player, called
+// on every ping
+func (server *GameServer) updateNetMetrics() {
+	for _, player := range server.players {
+		net := player.netStats()
+		id, nickname := playerLabel(player), player.Nickname
+		playerJitter.With(id, nickname).Set(net.RTT.Jitter)
+		playerPongLoss.With(id, nickname).Set(net.PongLoss)
+		for _, q := range net.Queues {
+			channelQueued.With(id, nickname, q.Channel).Set(float64(q.Bytes))
+		}
+	}
+}
+
+// Data channel counters are exported this often
+const channelStatsInterval = 5 * time.Second
+
+// collectChannelStats exports the data channel counters of every player until
+// the game loop stops. pion builds a whole stats report per peer, so they're
+// read beside the loop rather than on it, and only exported on the loop for
+// players that are still there.
+func (server *GameServer) collectChannelStats() {
+	ticker := time.NewTicker(channelStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.done:
+			return
+		case <-ticker.C:
+		}
+
+		type peer struct {
+			player  *Player
+			session *webrtc_session.PeerSession
+		}
+		var peers []peer
+		server.do(func() {
+			for _, player := range server.players {
+				peers = append(peers, peer{player, player.Session})
+			}
+		})
+
+		stats := make([][]webrtc_session.ChannelStats, len(peers))
+		for i, p := range peers {
+			stats[i] = p.session.ChannelStats()
+		}
+
+		server.post(func() {
+			for i, p := range peers {
+				if !slices.Contains(server.players, p.player) {
+					continue
+				}
+				id, nickname := playerLabel(p.player), p.player.Nickname
+				for _, c := range stats[i] {
+					channelBuffered.With(id, nickname, c.Label).Set(float64(c.BufferedAmount))
+					channelBytesSent.With(id, nickname, c.Label).Set(float64(c.BytesSent))
+					channelBytesReceived.With(id, nickname, c.Label).Set(float64(c.BytesReceived))
+					channelMessagesSent.With(id, nickname, c.Label).Set(float64(c.MessagesSent))
+					channelMessagesReceived.With(id, nickname, c.Label).Set(float64(c.MessagesReceived))
+				}
+			}
+		})
+	}
+}
+
+func deleteNetMetrics(player *Player) {
+	id, nickname := playerLabel(player), player.Nickname
+	playerPing.Delete(id, nickname)
+	playerJitter.Delete(id, nickname)
+	playerPongLoss.Delete(id, nickname)
+	for _, label := range []string{"reliable", "unreliable"} {
+		channelBuffered.Delete(id, nickname, label)
+		channelBytesSent.Delete(id, nickname, label)
+		channelBytesReceived.Delete(id, nickname, label)
+		channelMessagesSent.Delete(id, nickname, label)
+		channelMessagesReceived.Delete(id, nickname, label)
+		channelQueued.Delete(id, nickname, label)
+	}
+}
@@ -0,0 +1,200 @@
+package game
+
+import (
+	"errors"
+	"polyserver/config"
+	gamepackets "polyserver/game/packets"
+	webrtc_session "polyserver/webrtc"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+//
+// OUTBOUND QUEUE
+//
+
+var errOutboundClosed = errors.New("outbound queue overflowed, player is being disconnected")
+
+type outboundPacket struct {
+	kind gamepackets.PlayerPacketType
+	data []byte
+}
+
+// channelQueue holds the packets a data channel has no room for yet
+type channelQueue struct {
+	dc    *webrtc.DataChannel
+	limit int
+	// Unreliable queues make room by dropping their oldest packets, a full
+	// reliable queue means the player can't keep up
+	dropOldest bool
+	packets    []outboundPacket
+	bytes      int
+	dropped    int
+	errors     int
+}
+
+// outbound sends the packets of a player from its own writer goroutine, so
+// the game loop never waits on a data channel and a slow connection can't
+// pile up data. The writer hands a data channel packets while less than
+// network.sendBuffer bytes wait in it; the rest stays queued until pion
+// reports the buffer drained.
+type outbound struct {
+	lock       sync.Mutex
+	sendBuffer uint64
+	reliable   *channelQueue
+	unreliable *channelQueue
+	closed     bool
+	// Wakes the writer when packets are queued or a buffer drained
+	wake chan struct{}
+	// Called once when the reliable queue overflows
+	onOverflow func()
+}
+
+func newOutbound(session *webrtc_session.PeerSession, onOverflow func()) *outbound {
+	cfg := config.Current().Network
+	o := &outbound{
+		sendBuffer: uint64(cfg.SendBuffer),
+		reliable:   &channelQueue{dc: session.ReliableDC, limit: cfg.ReliableQueueLimit},
+		unreliable: &channelQueue{dc: session.UnreliableDC, limit: cfg.UnreliableQueueLimit, dropOldest: true},
+		wake:       make(chan struct{}, 1),
+		onOverflow: onOverflow,
+	}
+	for _, q := range []*channelQueue{o.reliable, o.unreliable} {
+		q.dc.SetBufferedAmountLowThreshold(o.sendBuffer / 2)
+		q.dc.OnBufferedAmountLow(o.signal)
+	}
+	go o.run()
+	return o
+}
+
+func (o *outbound) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// send queues a packet for the writer. It only fails once the player's
+// reliable queue overflowed.
+func (o *outbound) send(q *channelQueue, packet outboundPacket) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed {
+		return errOutboundClosed
+	}
+
+	q.packets = append(q.packets, packet)
+	q.bytes += len(packet.data)
+	for q.bytes > q.limit {
+		if !q.dropOldest {
+			o.closed = true
+			q.packets, q.bytes = nil, 0
+			go o.onOverflow()
+			break
+		}
+		q.drop()
+	}
+	o.signal()
+	if o.closed {
+		return errOutboundClosed
+	}
+	return nil
+}
+
+// close stops the writer, whatever is still queued is dropped
+func (o *outbound) close() {
+	o.lock.Lock()
+	o.closed = true
+	o.reliable.packets, o.reliable.bytes = nil, 0
+	o.unreliable.packets, o.unreliable.bytes = nil, 0
+	o.lock.Unlock()
+	o.signal()
+}
+
+// drop removes the oldest car update, or the oldest packet if none is queued
+func (q *channelQueue) drop() {
+	index := 0
+	for i, p := range q.packets {
+		if p.kind == gamepackets.PlayerCarUpdate {
+			index = i
+			break
+		}
+	}
+	q.bytes -= len(q.packets[index].data)
+	packetsDropped.With(q.dc.Label()).Inc()
+	q.dropped++
+	q.packets = append(q.packets[:index], q.packets[index+1:]...)
+}
+
+// run is the writer goroutine
+func (o *outbound) run() {
+	for range o.wake {
+		o.lock.Lock()
+		closed := o.closed
+		o.lock.Unlock()
+		if closed {
+			return
+		}
+		o.flush(o.reliable)
+		o.flush(o.unreliable)
+	}
+}
+
+// flush sends queued packets while the data channel has room
+func (o *outbound) flush(q *channelQueue) {
+	for q.dc.BufferedAmount() < o.sendBuffer {
+		o.lock.Lock()
+		if o.closed || len(q.packets) == 0 {
+			o.lock.Unlock()
+			return
+		}
+		packet := q.packets[0]
+		q.packets[0] = outboundPacket{}
+		q.packets = q.packets[1:]
+		q.bytes -= len(packet.data)
+		o.lock.Unlock()
+
+		if err := q.dc.Send(packet.data); err != nil {
+			o.lock.Lock()
+			q.errors++
+			o.lock.Unlock()
+			sendErrors.With(q.dc.Label()).Inc()
+			continue
+		}
+		packetsSent.With(packet.kind.String()).Inc()
+	}
+}
+
+// carUpdatesQueued reports whether car updates are still waiting for room
+// in the unreliable data channel
+func (o *outbound) carUpdatesQueued() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.unreliable.packets) > 0
+}
+
+type QueueStats struct {
+	Channel string `json:"channel"`
+	// Waiting for room in the data channel
+	Packets    int `json:"packets"`
+	Bytes      int `json:"bytes"`
+	Dropped    int `json:"dropped"`
+	SendErrors int `json:"sendErrors"`
+}
+
+func (o *outbound) stats() []QueueStats {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	stats := make([]QueueStats, 0, 2)
+	for _, q := range []*channelQueue{o.reliable, o.unreliable} {
+		stats = append(stats, QueueStats{
+			Channel:    q.dc.Label(),
+			Packets:    len(q.packets),
+			Bytes:      q.bytes,
+			Dropped:    q.dropped,
+			SendErrors: q.errors,
+		})
+	}
+	return stats
+}
@@ -0,0 +1,80 @@
+package game
+
+import (
+	"sync"
+	"time"
+)
+
+// Read-only views of the server state for broadcast overlays
+
+const recentRecordsSize = 20
+
+type RecentRecord struct {
+	RecordEvent
+	Time time.Time `json:"time"`
+}
+
+// recentRecords keeps the last records driven, across sessions
+type recentRecords struct {
+	lock    sync.Mutex
+	records []RecentRecord
+}
+
+func (r *recentRecords) add(record RecordEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records = append(r.records, RecentRecord{RecordEvent: record, Time: time.Now()})
+	if len(r.records) > recentRecordsSize {
+		r.records = r.records[len(r.records)-recentRecordsSize:]
+	}
+}
+
+func (r *recentRecords) restore(record RecentRecord) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records = append(r.records, record)
+}
+
+// RecentRecords returns up to limit of the latest records, newest first
+func (server *GameServer) RecentRecords(limit int) []RecentRecord {
+	server.records.lock.Lock()
+	defer server.records.lock.Unlock()
+
+	records := make([]RecentRecord, 0, len(server.records.records))
+	for i := len(server.records.records) - 1; i >= 0 && len(records) < limit; i-- {
+		records = append(records, server.records.records[i])
+	}
+	return records
+}
+
+type NowPlaying struct {
+	SessionID   uint32     `json:"sessionId"`
+	GameMode    string     `json:"gamemode"`
+	Running     bool       `json:"running"`
+	TrackName   string     `json:"trackName"`
+	TrackAuthor string     `json:"trackAuthor"`
+	StartedAt   *time.Time `json:"startedAt"`
+	// Seconds since the session started, 0 while switching sessions
+	Elapsed float64 `json:"elapsed"`
+}
+
+// NowPlaying describes the current session and track
+func (server *GameServer) NowPlaying() NowPlaying {
+	session := server.Session()
+	now := NowPlaying{
+		SessionID: session.SessionID,
+		GameMode:  session.GameMode.String(),
+		Running:   !session.SwitchingSession,
+	}
+	if session.CurrentTrack != nil {
+		now.TrackName = session.CurrentTrack.Metadata.Name
+		if session.CurrentTrack.Metadata.Author != nil {
+			now.TrackAuthor = *session.CurrentTrack.Metadata.Author
+		}
+	}
+	if startedAt, ok := server.recorder.startedAt(); ok && now.Running {
+		now.StartedAt = &startedAt
+		now.Elapsed = time.Since(startedAt).Seconds()
+	}
+	return now
+}
@@ -28,11 +28,16 @@ type CarState struct {
 }
 
 type Vector3 struct {
-	X, Y, Z float32
+	X float32 `json:"x"`
+	Y float32 `json:"y"`
+	Z float32 `json:"z"`
 }
 
 type Quaternion struct {
-	X, Y, Z, W float32
+	X float32 `json:"x"`
+	Y float32 `json:"y"`
+	Z float32 `json:"z"`
+	W float32 `json:"w"`
 }
 
 type WheelContact struct {
@@ -269,11 +274,8 @@ func (cs *CarState) EncodeCarState() ([]byte, error) {
 	offset := 0
 
 	// Write frames (3 bytes, little-endian)
+	// Take only first 3 bytes, the fourth is overwritten by the next field
 	binary.LittleEndian.PutUint32(buf[offset:offset+4], cs.Frames)
-	// Take only first 3 bytes
-	buf[offset] = buf[offset]
-	buf[offset+1] = buf[offset+1]
-	buf[offset+2] = buf[offset+2]
 	offset += 3
 
 	// Write speedKmh (float32, 4 bytes)
@@ -301,9 +303,8 @@ func (cs *CarState) EncodeCarState() ([]byte, error) {
 
 	// Write finishFrames (optional, 3 bytes)
 	if cs.FinishFrames != nil {
-		binary.LittleEndian.PutUint32(buf[offset:offset+4], *cs.FinishFrames)
 		// Take only first 3 bytes
-		buf[offset+2] = buf[offset+2] // Keep third byte
+		binary.LittleEndian.PutUint32(buf[offset:offset+4], *cs.FinishFrames)
 		offset += 3
 	}
 
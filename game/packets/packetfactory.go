@@ -3,7 +3,6 @@ package gamepackets
 import (
 	"encoding/binary"
 	"fmt"
-	"log"
 )
 
 // PacketFactory helps create packets from raw data (for receiving)
@@ -16,6 +15,10 @@ func (f *PacketFactory) FromBytes(data []byte) (HostPacket, error) {
 
 	packetType := HostPacketType(data[0])
 
+	if len(data) < packetType.minLength() {
+		return nil, fmt.Errorf("%s packet too short: %d bytes", packetType.String(), len(data))
+	}
+
 	switch packetType {
 	case Pong:
 		return PongPacket{
@@ -24,7 +27,7 @@ func (f *PacketFactory) FromBytes(data []byte) (HostPacket, error) {
 	case HostCarUpdate:
 		carState, _, err := DecodeCarState(data[9:])
 		if err != nil {
-			log.Println("Error decoding car state: " + err.Error())
+			return nil, fmt.Errorf("error decoding car state: %w", err)
 		}
 		return HostCarUpdatePacket{
 			SessionID:    binary.LittleEndian.Uint32(data[1:5]),
@@ -29,6 +29,21 @@ func (pt HostPacketType) String() string {
 	}
 }
 
+// minLength is the smallest valid size of a packet of this type, including
+// the type byte
+func (pt HostPacketType) minLength() int {
+	switch pt {
+	case Pong:
+		return 2
+	case HostCarUpdate, HostCarReset:
+		return 9
+	case HostRecord:
+		return 8
+	default:
+		return 1
+	}
+}
+
 type PlayerPacketType uint8
 
 const (
@@ -3,9 +3,11 @@ package gamepackets
 import (
 	"encoding/binary"
 	"fmt"
-	"log"
+	"polyserver/logging"
 )
 
+var logger = logging.For("packets")
+
 type PlayerUpdatePacket struct {
 	ID          uint32
 	Nickname    string
@@ -63,7 +65,7 @@ func (p PlayerUpdatePacket) Marshal() ([]byte, error) {
 		buf = append(buf, 0)
 	} else {
 		buf = append(buf, 1)
-		log.Printf("Sending frames: %v\n", *p.NumFrames)
+		logger.Debug("Sending frames", "player", p.ID, "frames", *p.NumFrames)
 		tempBuf := make([]byte, 0)
 		tempBuf = binary.LittleEndian.AppendUint32(tempBuf, *p.NumFrames)
 		buf = append(buf, tempBuf[0])
@@ -2,19 +2,23 @@ package game
 
 import (
 	"fmt"
-	"log"
+	"polyserver/config"
+	"polyserver/events"
 	gamepackets "polyserver/game/packets"
 	webrtc_session "polyserver/webrtc"
-	"sync"
 	"time"
 
 	"github.com/pion/webrtc/v4"
 )
 
+// Player is owned by the game loop, only the outbound queue is used from
+// other goroutines
 type Player struct {
 	Session                 *webrtc_session.PeerSession
+	out                     *outbound
 	Server                  *GameServer
 	IsKicked                bool
+	KickReason              string
 	ID                      uint32
 	Mods                    []string
 	IsModsVanillaCompatible bool
@@ -26,9 +30,16 @@ type Player struct {
 	Ping                    int
 	PingIdCounter           uint8
 	PingPackages            []PingPackage
-	PPLock                  sync.Mutex
+	pings                   pingHistory
+	highPingSince           time.Time
 	UnsentCarStates         []gamepackets.CarState
-	CSLock                  sync.Mutex
+	LastCarState            *gamepackets.CarState
+	lastCarUpdate           time.Time
+	Progress                raceProgress
+	// Car the player watches, 0 for their own
+	spectating uint32
+	// Car update each car was last sent to this player in
+	carsSent map[uint32]uint64
 }
 
 type PingPackage struct {
@@ -37,53 +48,78 @@ type PingPackage struct {
 }
 
 func NewPlayer(p *Player) *Player {
+	p.out = newOutbound(p.Session, func() {
+		logger.Warn("Player can't keep up with reliable packets, disconnecting", "player", p.ID, "nickname", p.Nickname)
+		p.Session.Peer.Close()
+	})
 	p.Session.ReliableDC.OnMessage(func(msg webrtc.DataChannelMessage) {
-		p.HandleMessage(msg.Data)
+		p.receive(msg.Data)
 	})
 	p.Session.UnreliableDC.OnMessage(func(msg webrtc.DataChannelMessage) {
-		p.HandleMessage(msg.Data)
+		p.receive(msg.Data)
 	})
 	return p
 }
 
-func (player *Player) HandleMessage(data []byte) {
+// receive decodes a packet on the data channel's goroutine and hands it to
+// the game loop
+func (player *Player) receive(data []byte) {
 	packet, err := player.Server.Factory.FromBytes(data)
 	if err != nil {
-		log.Println("Error from packet: " + err.Error())
+		decodeErrors.Inc()
+		logger.Warn("Failed to decode packet", "player", player.ID, "err", err)
 		return
 	}
+	packetsReceived.With(packet.Type().String()).Inc()
+	player.Server.post(func() { player.HandlePacket(packet) })
+}
+
+// HandlePacket runs on the game loop
+func (player *Player) HandlePacket(packet gamepackets.HostPacket) {
 	switch packet.Type() {
 	case gamepackets.Pong:
 		pongPacket, _ := packet.(gamepackets.PongPacket)
-		// log.Printf("Received pong: %v", +pongPacket.PingId)
-		player.PPLock.Lock()
-		defer player.PPLock.Unlock()
 		for index, pingPacket := range player.PingPackages {
 			if pingPacket.PingId == int(pongPacket.PingId) {
 				player.Ping = int(time.Now().UnixMilli() - pingPacket.SentTime.UnixMilli())
+				player.Server.recorder.ping(player, player.Ping)
+				playerPing.With(playerLabel(player), player.Nickname).Observe(float64(player.Ping))
+				player.pings.add(pingSample{rtt: player.Ping})
 				player.PingPackages = append(player.PingPackages[:index], player.PingPackages[index+1:]...)
 				break
 			}
 		}
 	case gamepackets.HostCarUpdate:
 		updatePacket, _ := packet.(gamepackets.HostCarUpdatePacket)
-		// log.Printf("Update packet received from %v: %v\n", updatePacket.SessionID, updatePacket)
-		if updatePacket.SessionID == player.Server.GameSession.SessionID {
-			player.CSLock.Lock()
+		if updatePacket.SessionID == player.Server.session.SessionID {
+			player.lastCarUpdate = time.Now()
 			if updatePacket.ResetCounter > player.ResetCounter {
 				player.ResetCounter = updatePacket.ResetCounter
 				player.UnsentCarStates = make([]gamepackets.CarState, 0)
 			}
 			if updatePacket.ResetCounter == player.ResetCounter {
 				player.UnsentCarStates = append(player.UnsentCarStates, *updatePacket.CarState)
+				player.LastCarState = updatePacket.CarState
+				if player.Progress.update(updatePacket.CarState) {
+					player.Server.standingsDirty.Store(true)
+				}
 			}
-			player.CSLock.Unlock()
 		}
 	case gamepackets.HostRecord:
 		recordPacket, _ := packet.(gamepackets.HostRecordPacket)
-		if player.Server.GameSession.SessionID == recordPacket.SessionID {
+		if player.Server.session.SessionID == recordPacket.SessionID {
 			player.NumberOfFrames = &recordPacket.NumOfFrames
-			for _, p := range player.Server.Players {
+			player.Server.recorder.record(player, recordPacket.NumOfFrames)
+			record := RecordEvent{
+				ID:        player.ID,
+				Nickname:  player.Nickname,
+				SessionID: recordPacket.SessionID,
+				Frames:    recordPacket.NumOfFrames,
+			}
+			player.Server.records.add(record)
+			player.Server.stateDirty.Store(true)
+			player.Server.Events.Publish(events.Record, record)
+			for _, p := range player.Server.players {
 				if p.ID != player.ID {
 					p.SendPlayerUpdate(player)
 				}
@@ -91,14 +127,18 @@ func (player *Player) HandleMessage(data []byte) {
 		}
 	case gamepackets.HostCarReset:
 		resetPacket, _ := packet.(gamepackets.HostCarResetPacket)
-		if resetPacket.SessionID == player.Server.GameSession.SessionID && resetPacket.ResetCounter > player.ResetCounter {
+		if resetPacket.SessionID == player.Server.session.SessionID && resetPacket.ResetCounter > player.ResetCounter {
 			player.ResetCounter = resetPacket.ResetCounter
+			player.Server.recorder.reset(player, resetPacket.ResetCounter)
+			player.Server.Events.Publish(events.Reset, ResetEvent{
+				ID:           player.ID,
+				Nickname:     player.Nickname,
+				ResetCounter: resetPacket.ResetCounter,
+			})
 
-			player.CSLock.Lock()
 			player.UnsentCarStates = make([]gamepackets.CarState, 0)
-			player.CSLock.Unlock()
 
-			for _, p := range player.Server.Players {
+			for _, p := range player.Server.players {
 				if p.ID != player.ID {
 					p.Send(gamepackets.PlayerCarResetPacket{
 						ID:           player.ID,
@@ -107,18 +147,17 @@ func (player *Player) HandleMessage(data []byte) {
 				}
 			}
 		}
-		log.Printf("Reset packet: %v\n", resetPacket)
+		logger.Debug("Reset packet", "player", player.ID, "session", resetPacket.SessionID, "resetCounter", resetPacket.ResetCounter)
 	}
 }
 
 func (player *Player) Send(packet gamepackets.PlayerPacket) error {
 	data, err := packet.Marshal()
-	// log.Printf("Sending %s to %s", packet.Type(), player.Nickname)
 	if err != nil {
 		return fmt.Errorf("failed to marshal %s packet: %w", packet.Type(), err)
 	}
 
-	return player.Session.ReliableDC.Send(data)
+	return player.out.send(player.out.reliable, outboundPacket{kind: packet.Type(), data: data})
 }
 
 func (player *Player) SendUnreliable(packet gamepackets.PlayerPacket) error {
@@ -127,12 +166,12 @@ func (player *Player) SendUnreliable(packet gamepackets.PlayerPacket) error {
 		return fmt.Errorf("failed to marshal %s packet: %w", packet.Type(), err)
 	}
 
-	return player.Session.UnreliableDC.Send(data)
+	return player.out.send(player.out.unreliable, outboundPacket{kind: packet.Type(), data: data})
 }
 
 func (player *Player) SendTrack() error {
 	// Send track ID
-	trackId, err := player.Server.GameSession.CurrentTrack.GetTrackID()
+	trackId, err := player.Server.session.CurrentTrack.GetTrackID()
 	if err != nil {
 		return fmt.Errorf("failed to get track ID: %w", err)
 	}
@@ -143,7 +182,7 @@ func (player *Player) SendTrack() error {
 
 	// Get the exported track string (base62 encoded)
 	// This should be the same as n.toExportString(t) in JS
-	trackString := player.Server.GameSession.CurrentTrack.ExportString
+	trackString := player.Server.session.CurrentTrack.ExportString
 
 	// Send track data in chunks of 16383 bytes
 	for offset := 0; offset < len(trackString); offset += 16383 {
@@ -161,8 +200,9 @@ func (player *Player) SendTrack() error {
 		// Copy string characters directly (they're ASCII/base62)
 		copy(packet[1:], trackString[offset:chunkEnd])
 
-		// Send the raw packet
-		if err := player.Session.ReliableDC.Send(packet); err != nil {
+		// Queue the raw packet, chunks go out as the data channel drains
+		err := player.out.send(player.out.reliable, outboundPacket{kind: gamepackets.TrackChunk, data: packet})
+		if err != nil {
 			return fmt.Errorf("failed to send chunk at offset %d: %w", offset, err)
 		}
 	}
@@ -172,9 +212,9 @@ func (player *Player) SendTrack() error {
 
 func (player *Player) StartNewSession() {
 	player.Send(gamepackets.NewSessionPacket{
-		SessionID:  player.Server.GameSession.SessionID,
-		GameMode:   uint8(player.Server.GameSession.GameMode),
-		MaxPlayers: uint8(player.Server.GameSession.MaxPlayers),
+		SessionID:  player.Server.session.SessionID,
+		GameMode:   uint8(player.Server.session.GameMode),
+		MaxPlayers: uint8(player.Server.session.MaxPlayers),
 	})
 }
 
@@ -183,15 +223,18 @@ func (player *Player) SendPing() {
 	player.SendUnreliable(gamepackets.PingPacket{
 		PingId: player.PingIdCounter,
 	})
-	player.PPLock.Lock()
-	defer player.PPLock.Unlock()
+	now := time.Now()
+	// Pings are sent in order, so the unanswered ones that timed out are
+	// at the front. At most timeout/interval pings are waiting for a pong.
+	timeout := max(time.Duration(config.Current().Network.PongTimeout), player.Server.ticks.ping)
+	for len(player.PingPackages) > 0 && now.Sub(player.PingPackages[0].SentTime) > timeout {
+		player.pings.add(pingSample{lost: true})
+		player.PingPackages = append(player.PingPackages[:0], player.PingPackages[1:]...)
+	}
 	player.PingPackages = append(player.PingPackages, PingPackage{
 		PingId:   int(player.PingIdCounter),
-		SentTime: time.Now(),
+		SentTime: now,
 	})
-	if len(player.PingPackages) > 10 {
-		player.PingPackages = append(player.PingPackages[:0], player.PingPackages[1:]...)
-	}
 }
 
 func (player *Player) SendPlayerUpdate(p *Player) {
@@ -203,6 +246,6 @@ func (player *Player) SendPlayerUpdate(p *Player) {
 		NumFrames:   p.NumberOfFrames,
 	})
 	if err != nil {
-		log.Println("Error sending player update: " + err.Error())
+		logger.Warn("Failed to send player update", "player", player.ID, "err", err)
 	}
 }
@@ -1,6 +1,9 @@
 package game
 
-import gametrack "polyserver/game/track"
+import (
+	"polyserver/config"
+	gametrack "polyserver/game/track"
+)
 
 type GameSession struct {
 	SessionID        uint32           `json:"sessionId"`
@@ -8,6 +11,10 @@ type GameSession struct {
 	SwitchingSession bool             `json:"switchingSession"`
 	CurrentTrack     *gametrack.Track `json:"currentTrack"`
 	MaxPlayers       int              `json:"maxPlayers"`
+	// Tick rates of this session, 0 uses timing.carUpdateInterval and
+	// timing.pingInterval
+	CarUpdateInterval config.Duration `json:"carUpdateInterval"`
+	PingInterval      config.Duration `json:"pingInterval"`
 }
 
 // TODO: Proper session switching
@@ -0,0 +1,105 @@
+package game
+
+import (
+	gamepackets "polyserver/game/packets"
+	gametrack "polyserver/game/track"
+)
+
+// CarPosition is where a player's car was at its latest update
+type CarPosition struct {
+	ID         uint32                 `json:"id"`
+	Nickname   string                 `json:"nickname"`
+	Color      uint32                 `json:"color"`
+	Frames     uint32                 `json:"frames"`
+	SpeedKmh   float32                `json:"speedKmh"`
+	Finished   bool                   `json:"finished"`
+	Position   gamepackets.Vector3    `json:"position"`
+	Quaternion gamepackets.Quaternion `json:"quaternion"`
+}
+
+// CarPositions returns the latest position of every player that has sent a
+// car update in the current session
+func (server *GameServer) CarPositions() []CarPosition {
+	var positions []CarPosition
+	server.do(func() { positions = server.carPositions() })
+	return positions
+}
+
+func (server *GameServer) carPositions() []CarPosition {
+	positions := make([]CarPosition, 0, len(server.players))
+	for _, player := range server.players {
+		state := player.LastCarState
+		if state == nil {
+			continue
+		}
+
+		color := gamepackets.DefaultCarStyle().Color1
+		if player.CarStyle != nil {
+			color = player.CarStyle.Color1
+		}
+
+		positions = append(positions, CarPosition{
+			ID:         player.ID,
+			Nickname:   player.Nickname,
+			Color:      color,
+			Frames:     state.Frames,
+			SpeedKmh:   state.SpeedKmh,
+			Finished:   state.FinishFrames != nil,
+			Position:   state.Position,
+			Quaternion: state.Quaternion,
+		})
+	}
+	return positions
+}
+
+// TrackLayout is the block layout of a track for drawing a map
+type TrackLayout struct {
+	Name   string        `json:"name"`
+	Author *string       `json:"author"`
+	Env    string        `json:"env"`
+	Blocks []LayoutBlock `json:"blocks"`
+}
+
+type LayoutBlock struct {
+	X        int32  `json:"x"`
+	Y        int32  `json:"y"`
+	Z        int32  `json:"z"`
+	Part     uint8  `json:"part"`
+	Rotation uint8  `json:"rotation"`
+	Color    uint8  `json:"color"`
+	Kind     string `json:"kind,omitempty"` // "checkpoint" or "start"
+}
+
+func NewTrackLayout(track *gametrack.Track) TrackLayout {
+	layout := TrackLayout{
+		Name:   track.Metadata.Name,
+		Author: track.Metadata.Author,
+		Blocks: []LayoutBlock{},
+	}
+	if track.Data == nil {
+		return layout
+	}
+
+	layout.Env = track.Data.Env.String()
+	for _, part := range track.Data.Parts {
+		kind := ""
+		if gametrack.IsCheckpoint(part.ID) {
+			kind = "checkpoint"
+		} else if gametrack.IsStart(part.ID) {
+			kind = "start"
+		}
+		for _, block := range part.Blocks {
+			// Coordinates are stored unsigned but can be negative
+			layout.Blocks = append(layout.Blocks, LayoutBlock{
+				X:        int32(block.X),
+				Y:        int32(block.Y),
+				Z:        int32(block.Z),
+				Part:     part.ID,
+				Rotation: block.Rotation,
+				Color:    block.Color,
+				Kind:     kind,
+			})
+		}
+	}
+	return layout
+}
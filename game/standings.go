@@ -0,0 +1,151 @@
+package game
+
+import (
+	"polyserver/events"
+	gamepackets "polyserver/game/packets"
+	"sort"
+)
+
+// raceProgress is what a player has reached so far in the current session
+type raceProgress struct {
+	Checkpoint uint16
+	Frames     uint32
+	// Best finish of the session, kept when the player restarts
+	FinishFrames *uint32
+	// Frame count at which each checkpoint count was reached
+	Splits map[uint16]uint32
+}
+
+// update applies a car state and reports whether the standings changed
+func (rp *raceProgress) update(state *gamepackets.CarState) bool {
+	// Frames going back means the player restarted the run
+	if rp.Splits == nil || state.Frames < rp.Frames {
+		*rp = raceProgress{Splits: map[uint16]uint32{}, FinishFrames: rp.FinishFrames}
+	}
+	rp.Frames = state.Frames
+
+	changed := false
+	if state.NextCheckpointIndex != rp.Checkpoint {
+		rp.Checkpoint = state.NextCheckpointIndex
+		if _, ok := rp.Splits[rp.Checkpoint]; !ok {
+			rp.Splits[rp.Checkpoint] = state.Frames
+		}
+		changed = true
+	}
+	if state.FinishFrames != nil && (rp.FinishFrames == nil || *state.FinishFrames < *rp.FinishFrames) {
+		finish := *state.FinishFrames
+		rp.FinishFrames = &finish
+		changed = true
+	}
+	return changed
+}
+
+type Standing struct {
+	Position     int     `json:"position"`
+	ID           uint32  `json:"id"`
+	Nickname     string  `json:"nickname"`
+	Finished     bool    `json:"finished"`
+	FinishFrames *uint32 `json:"finishFrames"`
+	Checkpoint   uint16  `json:"checkpoint"`
+	Frames       uint32  `json:"frames"`
+	// Frames behind the leader at the last checkpoint both reached, nil when
+	// they can't be compared
+	GapFrames         *int64 `json:"gapFrames"`
+	CheckpointsBehind int    `json:"checkpointsBehind"`
+
+	splits map[uint16]uint32
+}
+
+// splitFrames is when the standing reached its current checkpoint, or its
+// finish time once finished
+func (s *Standing) splitFrames() (uint32, bool) {
+	if s.FinishFrames != nil {
+		return *s.FinishFrames, true
+	}
+	frames, ok := s.splits[s.Checkpoint]
+	return frames, ok && s.Checkpoint > 0
+}
+
+// Standings ranks the players of the current session: finishers by time,
+// then everyone else by checkpoints reached and when they reached them
+func (server *GameServer) Standings() []Standing {
+	var standings []Standing
+	server.do(func() { standings = server.standings() })
+	return standings
+}
+
+func (server *GameServer) standings() []Standing {
+	standings := make([]Standing, 0, len(server.players))
+	for _, player := range server.players {
+		progress := player.Progress
+		splits := make(map[uint16]uint32, len(progress.Splits))
+		for cp, frames := range progress.Splits {
+			splits[cp] = frames
+		}
+
+		standings = append(standings, Standing{
+			ID:           player.ID,
+			Nickname:     player.Nickname,
+			Finished:     progress.FinishFrames != nil,
+			FinishFrames: progress.FinishFrames,
+			Checkpoint:   progress.Checkpoint,
+			Frames:       progress.Frames,
+			splits:       splits,
+		})
+	}
+
+	sort.SliceStable(standings, func(i, j int) bool {
+		a, b := &standings[i], &standings[j]
+		if a.Finished != b.Finished {
+			return a.Finished
+		}
+		if a.Finished {
+			return *a.FinishFrames < *b.FinishFrames
+		}
+		if a.Checkpoint != b.Checkpoint {
+			return a.Checkpoint > b.Checkpoint
+		}
+		aFrames, aOk := a.splitFrames()
+		bFrames, bOk := b.splitFrames()
+		if aOk && bOk && aFrames != bFrames {
+			return aFrames < bFrames
+		}
+		return a.ID < b.ID
+	})
+
+	if len(standings) == 0 {
+		return standings
+	}
+
+	leader := &standings[0]
+	for i := range standings {
+		s := &standings[i]
+		s.Position = i + 1
+		s.CheckpointsBehind = int(leader.Checkpoint) - int(s.Checkpoint)
+
+		var leaderFrames, frames uint32
+		var ok bool
+		if s.Finished && leader.Finished {
+			leaderFrames, frames, ok = *leader.FinishFrames, *s.FinishFrames, true
+		} else if s.Checkpoint > 0 {
+			// Compare against when the leader passed the same checkpoint
+			var leaderOk, playerOk bool
+			leaderFrames, leaderOk = leader.splits[s.Checkpoint]
+			frames, playerOk = s.splits[s.Checkpoint]
+			ok = leaderOk && playerOk
+		}
+		if ok {
+			gap := int64(frames) - int64(leaderFrames)
+			s.GapFrames = &gap
+		}
+	}
+	return standings
+}
+
+// publishStandings sends the standings on the event stream when they changed
+func (server *GameServer) publishStandings() {
+	if !server.standingsDirty.Swap(false) {
+		return
+	}
+	server.Events.Publish(events.Standings, server.standings())
+}
@@ -0,0 +1,147 @@
+package game
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"polyserver/config"
+	"sync"
+	"time"
+)
+
+//
+// STATE
+//
+
+// ServerState is what survives a restart of the server process
+type ServerState struct {
+	SessionID        uint32   `json:"sessionId"`
+	GameMode         GameMode `json:"gamemode"`
+	SwitchingSession bool     `json:"switchingSession"`
+	MaxPlayers       int      `json:"maxPlayers"`
+	// Tick rates the session was set up with, 0 for the defaults
+	CarUpdateInterval config.Duration `json:"carUpdateInterval"`
+	PingInterval      config.Duration `json:"pingInterval"`
+	TrackID           string          `json:"trackId"`
+	TrackName         string          `json:"trackName"`
+	// Main invite, asked for again after a restart where the signaling
+	// server allows it
+	Invite        string         `json:"invite"`
+	RecentRecords []RecentRecord `json:"recentRecords"`
+	// Results of the session that was running, archived on restore
+	Running *SessionSummary `json:"running"`
+	SavedAt time.Time       `json:"savedAt"`
+}
+
+// StateStore keeps the server state in a JSON file
+type StateStore struct {
+	Path string
+	lock sync.Mutex
+}
+
+// Load reads the saved state, nil if there is none yet
+func (s *StateStore) Load() (*ServerState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state: %w", err)
+	}
+	var state ServerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid state file: %w", err)
+	}
+	return &state, nil
+}
+
+func (s *StateStore) Save(state *ServerState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	// Write to a temp file first so a crash never leaves a half-written state
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// SaveState writes the current state right away
+func (server *GameServer) SaveState() {
+	server.do(server.saveState)
+}
+
+func (server *GameServer) saveState() {
+	if server.StateStore == nil {
+		return
+	}
+	server.stateDirty.Store(false)
+
+	session := server.session
+	state := &ServerState{
+		SessionID:         session.SessionID,
+		GameMode:          session.GameMode,
+		SwitchingSession:  session.SwitchingSession,
+		MaxPlayers:        session.MaxPlayers,
+		CarUpdateInterval: session.CarUpdateInterval,
+		PingInterval:      session.PingInterval,
+		Invite:            server.SignalingServer.CurrentInvite(),
+		RecentRecords:     server.RecentRecords(recentRecordsSize),
+		Running:           server.recorder.snapshot(),
+		SavedAt:           time.Now(),
+	}
+	if session.CurrentTrack != nil {
+		state.TrackName = session.CurrentTrack.Metadata.Name
+		state.TrackID, _ = session.CurrentTrack.GetTrackID()
+	}
+
+	if err := server.StateStore.Save(state); err != nil {
+		logger.Error("Failed to save server state", "err", err)
+	}
+}
+
+// saveStateIfChanged is run on a timer to save results as they come in
+func (server *GameServer) saveStateIfChanged() {
+	if server.stateDirty.Load() {
+		server.saveState()
+	}
+}
+
+// RestoreState picks up where a previous process left off. Session IDs
+// continue from the saved one so packets for old sessions are rejected, and
+// the results of the session that was running get archived, and the main
+// invite asks for the previous code. The session itself is restored by the
+// caller, which knows the tracks.
+func (server *GameServer) RestoreState(state *ServerState) {
+	server.do(func() { server.session.SessionID = state.SessionID })
+	if state.Invite != "" {
+		server.SignalingServer.ReclaimInvite(state.Invite)
+	}
+
+	// RecentRecords is newest first
+	for i := len(state.RecentRecords) - 1; i >= 0; i-- {
+		server.records.restore(state.RecentRecords[i])
+	}
+
+	if state.Running != nil && server.Archive != nil {
+		summary := state.Running
+		summary.EndedAt = state.SavedAt
+		if err := server.Archive.Save(summary); err != nil {
+			logger.Error("Failed to archive interrupted session", "session", summary.SessionID, "err", err)
+		} else {
+			logger.Info("Archived interrupted session", "session", summary.SessionID, "participants", len(summary.Participants))
+		}
+	}
+
+	logger.Info("Restored server state", "session", state.SessionID, "savedAt", state.SavedAt, "previousInvite", state.Invite)
+}
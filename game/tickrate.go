@@ -0,0 +1,123 @@
+package game
+
+import (
+	"polyserver/config"
+	"time"
+)
+
+//
+// TICK RATES
+//
+
+// ticks are the game loop's ping and car update tickers, owned by the loop
+type ticks struct {
+	pings      *time.Ticker
+	carUpdates *time.Ticker
+	ping       time.Duration
+	carUpdate  time.Duration
+	// Car update interval before adapting to the load
+	carUpdateBase time.Duration
+}
+
+func newTicks(carUpdate, ping time.Duration) *ticks {
+	carUpdateInterval.Set(carUpdate.Seconds())
+	return &ticks{
+		pings:         time.NewTicker(ping),
+		carUpdates:    time.NewTicker(carUpdate),
+		ping:          ping,
+		carUpdate:     carUpdate,
+		carUpdateBase: carUpdate,
+	}
+}
+
+// retime switches to new intervals, keeping an adapted car update interval
+// when the base didn't change
+func (t *ticks) retime(carUpdate, ping time.Duration) {
+	if ping != t.ping {
+		t.ping = ping
+		t.pings.Reset(ping)
+	}
+	if carUpdate != t.carUpdateBase {
+		t.carUpdateBase = carUpdate
+		t.setCarUpdate(carUpdate)
+	}
+}
+
+func (t *ticks) setCarUpdate(interval time.Duration) {
+	if interval == t.carUpdate {
+		return
+	}
+	t.carUpdate = interval
+	t.carUpdates.Reset(interval)
+	carUpdateInterval.Set(interval.Seconds())
+}
+
+func (t *ticks) stop() {
+	t.pings.Stop()
+	t.carUpdates.Stop()
+}
+
+// TickRates returns the car update and ping intervals in use, the car update
+// interval already adapted to the load
+func (server *GameServer) TickRates() (carUpdate, ping time.Duration) {
+	server.do(func() {
+		carUpdate, ping = server.ticks.carUpdate, server.ticks.ping
+	})
+	return carUpdate, ping
+}
+
+// tickIntervals returns the car update and ping intervals of the current
+// session
+func (server *GameServer) tickIntervals() (carUpdate, ping time.Duration) {
+	timing := config.Current().Timing
+	carUpdate = time.Duration(timing.CarUpdateInterval)
+	if server.session.CarUpdateInterval > 0 {
+		carUpdate = time.Duration(server.session.CarUpdateInterval)
+	}
+	ping = time.Duration(timing.PingInterval)
+	if server.session.PingInterval > 0 {
+		ping = time.Duration(server.session.PingInterval)
+	}
+	return carUpdate, ping
+}
+
+// playersBehind counts the players that still have car updates queued from
+// an earlier tick
+func (server *GameServer) playersBehind() int {
+	behind := 0
+	for _, player := range server.players {
+		if player.out.carUpdatesQueued() {
+			behind++
+		}
+	}
+	return behind
+}
+
+// adaptTickRates runs after every car update. It picks up changed intervals
+// and, with timing.adaptiveCarUpdates, stretches the car update interval by
+// a quarter while an update takes more than half of it or a quarter of the
+// players can't keep up, up to timing.maxCarUpdateInterval. Once updates
+// take less than a quarter of the interval and nobody is behind it shrinks
+// by a tenth back towards the session's interval.
+func (server *GameServer) adaptTickRates(took time.Duration, behind int) {
+	server.ticks.retime(server.tickIntervals())
+
+	timing := config.Current().Timing
+	base, current := server.ticks.carUpdateBase, server.ticks.carUpdate
+	if !timing.AdaptiveCarUpdates {
+		server.ticks.setCarUpdate(base)
+		return
+	}
+
+	interval := current
+	switch {
+	case took > current/2 || behind > 0 && behind*4 >= len(server.players):
+		interval = min(current+current/4, max(time.Duration(timing.MaxCarUpdateInterval), base))
+	case took < current/4 && behind == 0:
+		interval = max(current-current/10, base)
+	}
+	if interval != current {
+		logger.Debug("Adapting car update interval", "interval", interval, "took", took, "behind", behind)
+		server.ticks.setCarUpdate(interval)
+	}
+}
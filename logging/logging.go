@@ -0,0 +1,225 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Options struct {
+	Format string // "json" or "text"
+	Level  string // default level for every subsystem
+	Levels string // per-subsystem overrides, e.g. "game=debug,webrtc=warn"
+
+	File        string        // empty logs to stdout only
+	MaxSizeMB   int           // rotate once the file grows past this, 0 disables
+	RotateEvery time.Duration // rotate after this long, 0 disables
+	MaxBackups  int           // rotated files to keep, 0 keeps all
+	MaxAge      time.Duration // delete rotated files older than this, 0 keeps all
+}
+
+var (
+	base      atomic.Pointer[slog.Handler]
+	output    io.Closer
+	levelLock sync.Mutex
+	defaults  = new(slog.LevelVar)
+	levels    = map[string]*slog.LevelVar{}
+	overrides = map[string]bool{}
+)
+
+func init() {
+	var h slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+	base.Store(&h)
+}
+
+// Setup replaces the output of every logger. Loggers created with For
+// before Setup pick up the new output.
+func Setup(opts Options) error {
+	if err := SetLevels(opts.Level, opts.Levels); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if opts.File != "" {
+		file, err := NewRotatingFile(opts.File, opts.MaxSizeMB, opts.RotateEvery, opts.MaxBackups, opts.MaxAge)
+		if err != nil {
+			return err
+		}
+		output = file
+		w = io.MultiWriter(os.Stdout, file)
+	}
+
+	// Levels are filtered per subsystem, the base handler lets everything through
+	handlerOpts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	switch opts.Format {
+	case "json":
+		h = slog.NewJSONHandler(w, handlerOpts)
+	case "text", "":
+		h = slog.NewTextHandler(w, handlerOpts)
+	default:
+		return fmt.Errorf("unknown log format %q", opts.Format)
+	}
+	base.Store(&h)
+
+	// Route the standard logger through slog as well
+	slog.SetDefault(For("main"))
+	log.SetFlags(0)
+	return nil
+}
+
+// Close flushes and closes the log file, if any
+func Close() error {
+	if output == nil {
+		return nil
+	}
+	return output.Close()
+}
+
+// For returns the logger of a subsystem
+func For(subsystem string) *slog.Logger {
+	return slog.New(&handler{
+		level: levelVar(subsystem),
+	}).With("subsystem", subsystem)
+}
+
+func levelVar(subsystem string) *slog.LevelVar {
+	levelLock.Lock()
+	defer levelLock.Unlock()
+	lv, ok := levels[subsystem]
+	if !ok {
+		lv = new(slog.LevelVar)
+		lv.Set(defaults.Level())
+		levels[subsystem] = lv
+	}
+	return lv
+}
+
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+// SetLevel changes the level of one subsystem, or of every subsystem without
+// an override when subsystem is empty or "*"
+func SetLevel(subsystem, value string) error {
+	level, err := ParseLevel(value)
+	if err != nil {
+		return err
+	}
+
+	if subsystem == "" || subsystem == "*" {
+		defaults.Set(level)
+		levelLock.Lock()
+		defer levelLock.Unlock()
+		for name, lv := range levels {
+			if !overrides[name] {
+				lv.Set(level)
+			}
+		}
+		return nil
+	}
+
+	levelVar(subsystem).Set(level)
+	levelLock.Lock()
+	overrides[subsystem] = true
+	levelLock.Unlock()
+	return nil
+}
+
+// SetLevels sets the default level and the per-subsystem overrides, e.g.
+// "game=debug,webrtc=warn". Overrides not in levels are dropped.
+func SetLevels(level, levels string) error {
+	if _, err := ParseLevel(level); err != nil {
+		return err
+	}
+	var pairs [][2]string
+	if levels != "" {
+		for _, pair := range strings.Split(levels, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				return fmt.Errorf("invalid log level override %q", pair)
+			}
+			if _, err := ParseLevel(value); err != nil {
+				return err
+			}
+			pairs = append(pairs, [2]string{name, value})
+		}
+	}
+
+	levelLock.Lock()
+	clear(overrides)
+	levelLock.Unlock()
+	SetLevel("", level)
+	for _, pair := range pairs {
+		SetLevel(pair[0], pair[1])
+	}
+	return nil
+}
+
+// Levels returns the current level of every known subsystem
+func Levels() map[string]string {
+	levelLock.Lock()
+	defer levelLock.Unlock()
+	out := map[string]string{"*": defaults.Level().String()}
+	names := make([]string, 0, len(levels))
+	for name := range levels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out[name] = levels[name].Level().String()
+	}
+	return out
+}
+
+//
+// HANDLER
+//
+
+// handler filters by its subsystem level and forwards to the current base
+// handler, so loggers created at package init follow later Setup calls
+type handler struct {
+	level *slog.LevelVar
+	ops   []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	out := *base.Load()
+	for _, op := range h.ops {
+		out = op(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{level: h.level, ops: append(ops, op)}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithGroup(name) })
+}
@@ -0,0 +1,164 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A failed rotation is retried after this long rather than on every line
+const rotateRetry = time.Minute
+
+// Rotated files are named after the log file plus this timestamp
+const rotatedTimeFormat = "20060102-150405.000"
+
+// RotatingFile is an io.Writer that moves the log file aside once it gets
+// too big or too old and prunes old rotated files
+type RotatingFile struct {
+	Path        string
+	MaxSize     int64
+	RotateEvery time.Duration
+	MaxBackups  int
+	MaxAge      time.Duration
+
+	lock     sync.Mutex
+	file     *os.File // nil after a rotation failed to reopen the file
+	closed   bool
+	size     int64
+	openedAt time.Time
+	retryAt  time.Time
+}
+
+func NewRotatingFile(path string, maxSizeMB int, rotateEvery time.Duration, maxBackups int, maxAge time.Duration) (*RotatingFile, error) {
+	r := &RotatingFile{
+		Path:        path,
+		MaxSize:     int64(maxSizeMB) * 1024 * 1024,
+		RotateEvery: rotateEvery,
+		MaxBackups:  maxBackups,
+		MaxAge:      maxAge,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	r.openedAt = time.Now()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+
+	tooBig := r.MaxSize > 0 && r.size+int64(len(p)) > r.MaxSize && r.size > 0
+	tooOld := r.RotateEvery > 0 && time.Since(r.openedAt) >= r.RotateEvery
+	if r.file != nil && (tooBig || tooOld) && !time.Now().Before(r.retryAt) {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the current file rather than dropping lines
+			fmt.Fprintln(os.Stderr, "log rotation failed, retrying in", rotateRetry, "-", err)
+			r.retryAt = time.Now().Add(rotateRetry)
+		}
+	}
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// rotate moves the file aside and opens a new one. When anything fails the
+// file is left closed and Write opens the original path again.
+func (r *RotatingFile) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(r.Path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(r.Path, ext), time.Now().Format(rotatedTimeFormat), ext)
+	if err := os.Rename(r.Path, rotated); err != nil {
+		return err
+	}
+
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// prune removes rotated files beyond MaxBackups or older than MaxAge
+func (r *RotatingFile) prune() {
+	ext := filepath.Ext(r.Path)
+	// Only names with the rotation timestamp, other files next to the log
+	// are left alone
+	var pattern strings.Builder
+	pattern.WriteString(strings.TrimSuffix(r.Path, ext) + "-")
+	for _, c := range rotatedTimeFormat {
+		if c >= '0' && c <= '9' {
+			pattern.WriteString("[0-9]")
+		} else {
+			pattern.WriteRune(c)
+		}
+	}
+	pattern.WriteString(ext)
+	matches, err := filepath.Glob(pattern.String())
+	if err != nil {
+		return
+	}
+
+	// The timestamp in the name sorts chronologically, newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(matches)))
+	for i, path := range matches {
+		remove := r.MaxBackups > 0 && i >= r.MaxBackups
+		if !remove && r.MaxAge > 0 {
+			if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > r.MaxAge {
+				remove = true
+			}
+		}
+		if remove {
+			os.Remove(path)
+		}
+	}
+}
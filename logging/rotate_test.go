@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPruneOnlyRotatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"server-20260101-000000.000.log",
+		"server-20260102-000000.000.log",
+		"server-20260103-000000.000.log",
+		"server-notes.log",
+		"server-20260101.log",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &RotatingFile{Path: filepath.Join(dir, "server.log"), MaxBackups: 1}
+	r.prune()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	want := []string{"server-20260101.log", "server-20260103-000000.000.log", "server-notes.log"}
+	if !slices.Equal(left, want) {
+		t.Errorf("left %v, want %v", left, want)
+	}
+}
+
+func TestFailedRotationBacksOff(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.log")
+	r, err := NewRotatingFile(path, 1, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.MaxSize = 10
+
+	if _, err := r.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	// The rename fails without the file, it's opened again to keep logging
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Over the size again, but the rotation isn't retried right away
+	if _, err := r.Write([]byte("a line that is over the size limit\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, _ := filepath.Glob(filepath.Join(dir, "server-*.log"))
+	if len(rotated) != 0 {
+		t.Errorf("rotated to %v while backing off", rotated)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first\na line that is over the size limit\n" {
+		t.Errorf("log has %q", data)
+	}
+}
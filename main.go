@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
+	"polyserver/config"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -41,30 +46,47 @@ func proxyJSON(c *fiber.Ctx, method, url string) error {
 	return c.Status(resp.StatusCode).Send(body)
 }
 
-func runLauncher(port int, controlPort int) {
+// proxyStream forwards a streaming response (Server-Sent Events) as it arrives
+func proxyStream(c *fiber.Ctx, url string) error {
 
-	log.Println("Launcher started")
-
-	var serverArgs []string
-
-	args := os.Args[1:]
-
-	for i := 0; i < len(args); i++ {
+	resp, err := http.Get(url)
+	if err != nil {
+		return c.Status(502).SendString(err.Error())
+	}
 
-		arg := args[i]
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return c.Status(resp.StatusCode).Send(body)
+	}
 
-		// Skip launcher flags AND their values
-		if arg == "-port" {
-			i++ // skip value
-			continue
+	c.Set("Content-Type", resp.Header.Get("Content-Type"))
+	c.Set("Cache-Control", "no-cache")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer resp.Body.Close()
+		buf := make([]byte, 4096)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				// A failed flush means the dashboard went away
+				if w.Flush() != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
 		}
+	})
 
-		if arg == "-server" {
-			continue
-		}
+	return nil
+}
 
-		serverArgs = append(serverArgs, arg)
-	}
+func runLauncher(port int, controlPort int, serverArgs []string, stopTimeout time.Duration, policy RestartPolicy) {
+
+	supervisorLogger.Info("Launcher started")
 
 	// Add server mode flag
 	serverArgs = append([]string{
@@ -72,71 +94,77 @@ func runLauncher(port int, controlPort int) {
 		"-control-port", strconv.Itoa(controlPort),
 	}, serverArgs...)
 
-	cmd := exec.Command(os.Args[0], serverArgs...)
-
-	stdout, _ := cmd.StdoutPipe()
-	stderr, _ := cmd.StderrPipe()
-
-	cmd.Stdin = os.Stdin
-
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+	sup := newSupervisor(serverArgs, controlPort, stopTimeout, policy)
+	if err := sup.start(); err != nil {
+		supervisorLogger.Error("Failed to start server", "err", err)
+		os.Exit(1)
 	}
 
-	log.Println("Server started with PID", cmd.Process.Pid)
-
-	go io.Copy(os.Stdout, stdout)
-	go io.Copy(os.Stderr, stderr)
+	stopDashboard := startSupervisorDashboard(port, sup, controlPort)
 
-	stopDashboard := startSupervisorDashboard(port, cmd, controlPort)
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	<-signals.Done()
+	stopSignals()
 
-	go func() {
-		err := cmd.Wait()
-		log.Println("Server exited:", err)
-	}()
+	supervisorLogger.Info("Stopping server...")
+	sup.stop()
+	stopDashboard()
+	supervisorLogger.Info("Launcher stopped")
+}
 
-	select {}
+// splitArgs separates the launcher's own flags from the ones passed on to the
+// server. Flags the launcher doesn't know are assumed to take a value unless
+// it's given with = or the next argument is another flag.
+func splitArgs(launcherFlags *flag.FlagSet, args []string) (launcherArgs, serverArgs []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+
+		takesValue := !hasValue && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-")
+		if f := launcherFlags.Lookup(name); f != nil {
+			if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+				takesValue = false
+			}
+			launcherArgs = append(launcherArgs, arg)
+			if takesValue {
+				i++
+				launcherArgs = append(launcherArgs, args[i])
+			}
+			continue
+		}
 
-	_ = stopDashboard
+		serverArgs = append(serverArgs, arg)
+		if strings.HasPrefix(arg, "-") && takesValue {
+			i++
+			serverArgs = append(serverArgs, args[i])
+		}
+	}
+	return launcherArgs, serverArgs
 }
 
-func startSupervisorDashboard(port int, cmd *exec.Cmd, controlPort int) func() {
+func startSupervisorDashboard(port int, sup *supervisor, controlPort int) func() {
 
 	app := fiber.New()
 
 	app.Static("/", "./web")
 
 	app.Get("/api/server/status", func(c *fiber.Ctx) error {
-		running := cmd.ProcessState == nil
-
-		return c.JSON(fiber.Map{
-			"running": running,
-			"pid":     cmd.Process.Pid,
-		})
+		return c.JSON(sup.status())
 	})
 
+	// Drains the server first and only kills it if it doesn't exit in time
 	app.Post("/api/server/stop", func(c *fiber.Ctx) error {
-		if cmd.Process != nil {
-			cmd.Process.Kill()
-		}
+		sup.stop()
 		return c.SendStatus(204)
 	})
 
 	app.Post("/api/server/start", func(c *fiber.Ctx) error {
-
-		if cmd.ProcessState == nil {
-			return c.SendString("Already running")
-		}
-
-		newCmd := exec.Command(os.Args[0], "server")
-		newCmd.Stdout = os.Stdout
-		newCmd.Stderr = os.Stderr
-
-		if err := newCmd.Start(); err != nil {
+		if err := sup.start(); errors.Is(err, errAlreadyRunning) {
+			return c.Status(409).SendString(err.Error())
+		} else if err != nil {
 			return c.Status(500).SendString(err.Error())
 		}
-
-		cmd = newCmd
 		return c.SendStatus(204)
 	})
 
@@ -175,12 +203,56 @@ func startSupervisorDashboard(port int, cmd *exec.Cmd, controlPort int) func() {
 		return proxyJSON(c, "GET", base+"/players")
 	})
 
+	app.Get("/api/standings", func(c *fiber.Ctx) error {
+		return proxyJSON(c, "GET", base+"/standings")
+	})
+
+	app.Get("/api/events", func(c *fiber.Ctx) error {
+		return proxyStream(c, base+"/events?"+string(c.Request().URI().QueryString()))
+	})
+
+	app.Get("/api/track/layout", func(c *fiber.Ctx) error {
+		return proxyJSON(c, "GET", base+"/track/layout")
+	})
+
+	app.Get("/api/spectate", func(c *fiber.Ctx) error {
+		return proxyStream(c, base+"/spectate?"+string(c.Request().URI().QueryString()))
+	})
+
+	// The versioned API is passed through as is
+	app.Get("/api/v1/events", func(c *fiber.Ctx) error {
+		return proxyStream(c, base+"/api/v1/events?"+string(c.Request().URI().QueryString()))
+	})
+	app.All("/api/v1/*", func(c *fiber.Ctx) error {
+		url := base + c.Path()
+		if query := c.Request().URI().QueryString(); len(query) > 0 {
+			url += "?" + string(query)
+		}
+		return proxyJSON(c, c.Method(), url)
+	})
+
+	app.Get("/api/tournament", func(c *fiber.Ctx) error {
+		return proxyJSON(c, "GET", base+"/tournament")
+	})
+	app.Post("/api/tournament", func(c *fiber.Ctx) error {
+		return proxyJSON(c, "POST", base+"/tournament")
+	})
+	app.Post("/api/tournament/heat/start", func(c *fiber.Ctx) error {
+		return proxyJSON(c, "POST", base+"/tournament/heat/start")
+	})
+	app.Post("/api/tournament/heat/finish", func(c *fiber.Ctx) error {
+		return proxyJSON(c, "POST", base+"/tournament/heat/finish")
+	})
+	app.Post("/api/tournament/reset", func(c *fiber.Ctx) error {
+		return proxyJSON(c, "POST", base+"/tournament/reset")
+	})
+
 	addr := fmt.Sprintf(":%d", port)
 
 	go func() {
-		log.Println("Dashboard running on http://localhost" + addr)
+		supervisorLogger.Info("Dashboard running", "url", "http://localhost"+addr)
 		if err := app.Listen(addr); err != nil {
-			log.Println(err)
+			supervisorLogger.Error("Dashboard stopped", "err", err)
 		}
 	}()
 
@@ -197,15 +269,38 @@ func main() {
 		return
 	}
 
-	launcherFlags := flag.NewFlagSet("launcher", flag.ContinueOnError)
+	launcherFlags := flag.NewFlagSet("launcher", flag.ExitOnError)
 
 	portFlag := launcherFlags.Int("port", 8080, "dashboard port")
 	controlPort := launcherFlags.Int("control-port", 9090, "server control port")
-
-	err := launcherFlags.Parse(os.Args[1:])
-	if err != nil {
-		log.Fatalln("Failed parsing flags!")
+	stopTimeout := launcherFlags.Duration("stop-timeout", 15*time.Second, "time the server gets to drain before it's killed")
+
+	var policy RestartPolicy
+	launcherFlags.DurationVar(&policy.Backoff, "restart-backoff", time.Second, "delay before restarting a crashed server, doubled on each crash")
+	launcherFlags.DurationVar(&policy.MaxBackoff, "restart-max-backoff", time.Minute, "longest delay between restarts")
+	launcherFlags.DurationVar(&policy.StableAfter, "restart-stable-after", 2*time.Minute, "uptime after which the restart delay resets")
+	launcherFlags.IntVar(&policy.MaxRestarts, "restart-max", 5, "crashes allowed inside the restart window before giving up, 0 never gives up")
+	launcherFlags.DurationVar(&policy.Window, "restart-window", 10*time.Minute, "window the crashes are counted in")
+
+	// Everything else is passed on to the server
+	launcherArgs, serverArgs := splitArgs(launcherFlags, os.Args[1:])
+	launcherFlags.Parse(launcherArgs)
+
+	// -config is the server's flag, but the launcher has to talk to the
+	// control port it sets
+	controlPortSet := false
+	launcherFlags.Visit(func(f *flag.Flag) {
+		controlPortSet = controlPortSet || f.Name == "control-port"
+	})
+	if !controlPortSet {
+		cfg, err := config.Load(configPath(serverArgs))
+		if err != nil {
+			supervisorLogger.Error("Failed to load config", "err", err)
+			os.Exit(1)
+		}
+		*controlPort = cfg.ControlPort
 	}
-	runLauncher(*portFlag, *controlPort)
+
+	runLauncher(*portFlag, *controlPort, serverArgs, *stopTimeout, policy)
 
 }
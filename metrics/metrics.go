@@ -0,0 +1,358 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds every metric that is exported on /metrics
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var Default = &Registry{}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, existing := range r.metrics {
+		if existing.name() == m.name() {
+			panic("metric registered twice: " + m.name())
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) {
+	r.lock.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.lock.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name() < metrics[j].name()
+	})
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelString renders label pairs as {a="1",b="2"}
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+//
+// COUNTER
+//
+
+type Counter struct {
+	metricName string
+	help       string
+	lock       sync.Mutex
+	value      float64
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{metricName: name, help: help}
+	Default.register(c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(v float64) {
+	c.lock.Lock()
+	c.value += v
+	c.lock.Unlock()
+}
+
+func (c *Counter) name() string { return c.metricName }
+
+func (c *Counter) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	writeHeader(w, c.metricName, c.help, "counter")
+	fmt.Fprintf(w, "%s %s\n", c.metricName, formatFloat(c.value))
+}
+
+//
+// GAUGE
+//
+
+type Gauge struct {
+	metricName string
+	help       string
+	lock       sync.Mutex
+	value      float64
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{metricName: name, help: help}
+	Default.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64) {
+	g.lock.Lock()
+	g.value = v
+	g.lock.Unlock()
+}
+
+func (g *Gauge) Add(v float64) {
+	g.lock.Lock()
+	g.value += v
+	g.lock.Unlock()
+}
+
+func (g *Gauge) Inc() { g.Add(1) }
+func (g *Gauge) Dec() { g.Add(-1) }
+
+func (g *Gauge) name() string { return g.metricName }
+
+func (g *Gauge) write(w io.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	writeHeader(w, g.metricName, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.value))
+}
+
+//
+// LABELED VECTORS
+//
+
+// vec keeps one series per distinct set of label values
+type vec[T any] struct {
+	metricName string
+	help       string
+	labels     []string
+	lock       sync.Mutex
+	series     map[string]*T
+	values     map[string][]string
+	create     func() *T
+}
+
+func (v *vec[T]) with(values ...string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", v.metricName, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = v.create()
+		v.series[key] = s
+		v.values[key] = append([]string(nil), values...)
+	}
+	return s
+}
+
+func (v *vec[T]) Delete(values ...string) {
+	key := strings.Join(values, "\xff")
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.series, key)
+	delete(v.values, key)
+}
+
+func (v *vec[T]) name() string { return v.metricName }
+
+// sorted returns the series ordered by label values so output is stable
+func (v *vec[T]) sorted() ([]*T, [][]string) {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	series := make([]*T, len(keys))
+	values := make([][]string, len(keys))
+	for i, key := range keys {
+		series[i] = v.series[key]
+		values[i] = v.values[key]
+	}
+	return series, values
+}
+
+func newVec[T any](name, help string, labels []string, create func() *T) vec[T] {
+	return vec[T]{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		series:     make(map[string]*T),
+		values:     make(map[string][]string),
+		create:     create,
+	}
+}
+
+type CounterVec struct {
+	vec[Counter]
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, labels, func() *Counter { return &Counter{} })}
+	Default.register(c)
+	return c
+}
+
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(values...)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	writeHeader(w, c.metricName, c.help, "counter")
+	series, values := c.sorted()
+	for i, s := range series {
+		s.lock.Lock()
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, labelString(c.labels, values[i]), formatFloat(s.value))
+		s.lock.Unlock()
+	}
+}
+
+type GaugeVec struct {
+	vec[Gauge]
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, labels, func() *Gauge { return &Gauge{} })}
+	Default.register(g)
+	return g
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.with(values...)
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	writeHeader(w, g.metricName, g.help, "gauge")
+	series, values := g.sorted()
+	for i, s := range series {
+		s.lock.Lock()
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, labelString(g.labels, values[i]), formatFloat(s.value))
+		s.lock.Unlock()
+	}
+}
+
+//
+// HISTOGRAM
+//
+
+type Histogram struct {
+	metricName string
+	help       string
+	buckets    []float64
+	lock       sync.Mutex
+	counts     []uint64
+	count      uint64
+	sum        float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	h.metricName = name
+	h.help = help
+	Default.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) name() string { return h.metricName }
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.metricName, h.help, "histogram")
+	h.writeSeries(w, h.metricName, nil, nil)
+}
+
+func (h *Histogram) writeSeries(w io.Writer, name string, labels, values []string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	bucketLabels := append(append([]string(nil), labels...), "le")
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelString(bucketLabels, append(append([]string(nil), values...), formatFloat(bound))), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelString(bucketLabels, append(append([]string(nil), values...), "+Inf")), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labelString(labels, values), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labelString(labels, values), h.count)
+}
+
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{newVec(name, help, labels, func() *Histogram { return newHistogram(buckets) })}
+	Default.register(h)
+	return h
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values...)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	writeHeader(w, h.metricName, h.help, "histogram")
+	series, values := h.sorted()
+	for i, s := range series {
+		s.writeSeries(w, h.metricName, h.labels, values[i])
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"polyserver/events"
+	"polyserver/game"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Event types the overlay server passes on. Invites stay on the control API
+// so they can't leak on stream.
+var overlayEvents = map[string]bool{
+	events.PlayerJoin:  true,
+	events.PlayerLeave: true,
+	events.Record:      true,
+	events.Session:     true,
+	events.Standings:   true,
+	events.Drain:       true,
+}
+
+// startOverlay serves the read-only overlay pages and feeds on addr. Nothing
+// here may change the server state.
+func startOverlay(gameServer *game.GameServer, addr string) *fiber.App {
+
+	app := fiber.New()
+
+	app.Get("/feed/now", func(c *fiber.Ctx) error {
+		return c.JSON(gameServer.NowPlaying())
+	})
+
+	app.Get("/feed/standings", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"sessionId": gameServer.Session().SessionID,
+			"standings": gameServer.Standings(),
+		})
+	})
+
+	app.Get("/feed/records", func(c *fiber.Ctx) error {
+		limit := c.QueryInt("limit", 10)
+		if limit < 1 {
+			return c.Status(400).SendString("limit must be positive")
+		}
+		return c.JSON(fiber.Map{
+			"records": gameServer.RecentRecords(limit),
+		})
+	})
+
+	// Same as the control API stream, restricted to overlayEvents
+	app.Get("/feed/events", func(c *fiber.Ctx) error {
+
+		filter := map[string]bool{}
+		for _, t := range strings.Split(c.Query("types"), ",") {
+			if overlayEvents[t] {
+				filter[t] = true
+			}
+		}
+		if len(filter) == 0 {
+			filter = overlayEvents
+		}
+
+		return streamEvents(c, gameServer.Events, filter)
+	})
+
+	app.Static("/", "./web/overlay")
+
+	go func() {
+		logger.Info("Overlay server running", "addr", addr)
+		if err := app.Listen(addr); err != nil {
+			logger.Error("Overlay server stopped", "err", err)
+		}
+	}()
+
+	return app
+}
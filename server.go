@@ -1,78 +1,226 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"os"
+	"os/signal"
+	"polyserver/config"
+	"polyserver/events"
 	"polyserver/game"
-	gamepackets "polyserver/game/packets"
+	gametrack "polyserver/game/track"
+	"polyserver/logging"
+	"polyserver/metrics"
 	"polyserver/signaling"
+	"polyserver/tournament"
 	"polyserver/tracks"
+	webrtc_session "polyserver/webrtc"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	pionwebrtc "github.com/pion/webrtc/v4"
 )
 
-func setupLogging() {
-	file, err := os.OpenFile(
-		"polyserver.log",
-		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
-		0666,
-	)
-	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
-	}
-
-	multi := io.MultiWriter(os.Stdout, file)
-
-	log.SetOutput(multi)
+var logger = logging.For("server")
 
-	// Optional: include date + time + file:line
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	logging.Close()
+	os.Exit(1)
 }
 
 func runServer() {
 
-	tracksDir := flag.String("tracks", "tracks/official", "track directory")
-	controlPort := flag.Int("control-port", 9090, "internal control port")
+	// The config file sets the defaults the flags override, so it has to be
+	// loaded before the flags are defined
+	configFile := configPath(os.Args[2:])
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	flag.Parse()
+	// Kept to tell which settings changed when the file is edited
+	loaded := *cfg
+
+	flag.String("config", configFile, "JSON config file, see polyserver.example.json")
+	flag.StringVar(&cfg.Signaling.Mode, "signaling", cfg.Signaling.Mode, "signaling server: kodub, or local to run a built-in one")
+	flag.StringVar(&cfg.Signaling.Listen, "signaling-listen", cfg.Signaling.Listen, "address of the built-in signaling server")
+	flag.StringVar(&cfg.TracksDir, "tracks", cfg.TracksDir, "track directory")
+	flag.IntVar(&cfg.ControlPort, "control-port", cfg.ControlPort, "internal control port")
+	flag.StringVar(&cfg.TournamentFile, "tournament", cfg.TournamentFile, "tournament bracket file")
+	flag.StringVar(&cfg.SessionsDir, "sessions", cfg.SessionsDir, "session results archive directory")
+	flag.StringVar(&cfg.StateFile, "state", cfg.StateFile, "file the session state is saved to across restarts")
+	flag.IntVar(&cfg.OverlayPort, "overlay-port", cfg.OverlayPort, "read-only overlay server port, 0 disables")
+	flag.StringVar(&cfg.OverlayBind, "overlay-bind", cfg.OverlayBind, "overlay server bind address")
+	flag.Var(&cfg.Timing.DrainGrace, "drain-grace", "time between ending the session and disconnecting players on shutdown")
+	flag.Var(&cfg.Timing.ShutdownTimeout, "shutdown-timeout", "time to wait for HTTP requests to finish on shutdown")
+
+	flag.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "log format: text or json")
+	flag.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "default log level: debug, info, warn or error")
+	flag.StringVar(&cfg.Log.Levels, "log-levels", cfg.Log.Levels, "per-subsystem log levels, e.g. game=debug,webrtc=warn")
+	flag.StringVar(&cfg.Log.File, "log-file", cfg.Log.File, "log file, empty to log to stdout only")
+	flag.IntVar(&cfg.Log.MaxSizeMB, "log-max-size", cfg.Log.MaxSizeMB, "rotate the log file after this many MB, 0 disables")
+	flag.Var(&cfg.Log.RotateEvery, "log-rotate", "rotate the log file after this long, 0 disables")
+	flag.IntVar(&cfg.Log.MaxBackups, "log-keep", cfg.Log.MaxBackups, "rotated log files to keep, 0 keeps all")
+	flag.Var(&cfg.Log.MaxAge, "log-max-age", "delete rotated log files older than this, 0 keeps all")
+
+	// os.Args[1] is the "server" mode argument
+	flag.CommandLine.Parse(os.Args[2:])
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid config:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	config.Apply(cfg)
+
+	if err := logging.Setup(logging.Options{
+		Format:      cfg.Log.Format,
+		Level:       cfg.Log.Level,
+		Levels:      cfg.Log.Levels,
+		File:        cfg.Log.File,
+		MaxSizeMB:   cfg.Log.MaxSizeMB,
+		RotateEvery: time.Duration(cfg.Log.RotateEvery),
+		MaxBackups:  cfg.Log.MaxBackups,
+		MaxAge:      time.Duration(cfg.Log.MaxAge),
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to set up logging:", err)
+		os.Exit(1)
+	}
+	defer logging.Close()
+
+	logger.Info("Game server starting...")
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
 
-	log.Println("Game server starting...")
+	if configFile != "" {
+		logger.Info("Loaded config", "file", configFile)
+		go watchConfig(configFile, &loaded, signals.Done())
+	}
 
-	tracksMap, trackNames := tracks.LoadAllTracks(*tracksDir)
+	tracksMap, trackNames := tracks.LoadAllTracks(cfg.TracksDir)
 	if len(trackNames) == 0 {
-		log.Fatal("No tracks found")
+		fatal("No tracks found", "dir", cfg.TracksDir)
 	}
 
 	defaultTrack := tracksMap[trackNames[0]]
+	if cfg.Session.Track != "" {
+		if t, ok := tracksMap[cfg.Session.Track]; ok {
+			defaultTrack = t
+		} else {
+			logger.Warn("Configured track is not loaded, using the first one", "track", cfg.Session.Track)
+		}
+	}
 
-	server := signaling.NewServer()
+	peerSettings := iceSettings(cfg.ICE)
+	if len(peerSettings.ICEServers) == 0 && cfg.Signaling.Mode == "kodub" {
+		urls, err := signaling.FetchICEServers(config.IceFetchUrl)
+		if err != nil {
+			fatal("Failed to fetch ICE servers", "err", err)
+		}
+		peerSettings.ICEServers = []pionwebrtc.ICEServer{{URLs: urls}}
+	}
+	logger.Info("Using ICE servers", "count", len(peerSettings.ICEServers), "policy", cfg.ICE.TransportPolicy)
+	peers, err := webrtc_session.NewPeers(peerSettings)
+	if err != nil {
+		fatal("Invalid ICE settings", "err", err)
+	}
+
+	var transport signaling.Transport = signaling.NewWebsocketTransport(config.WebsocketUrl)
+	var localSignaling *signaling.LocalServer
+	if cfg.Signaling.Mode == "local" {
+		localSignaling = signaling.NewLocalServer()
+		localSignaling.InviteTimeout = time.Duration(cfg.Signaling.InviteTimeout)
+		if err := localSignaling.Start(cfg.Signaling.Listen); err != nil {
+			fatal("Failed to start local signaling server", "err", err)
+		}
+		transport = localSignaling.HostTransport()
+	}
 
-	if err := server.Connect(); err != nil {
-		log.Fatal(err)
+	server := signaling.NewServer(transport, peers)
+	server.Reconnect = signaling.ReconnectPolicy{
+		Backoff:     time.Duration(cfg.Signaling.ReconnectBackoff),
+		MaxBackoff:  time.Duration(cfg.Signaling.ReconnectMaxBackoff),
+		MaxAttempts: cfg.Signaling.ReconnectMaxAttempts,
 	}
-	go server.Start()
 
 	gameServer := game.NewServer(server)
 
-	gameServer.UpdateGameSession(game.GameSession{
+	server.OnInvite = func(invite signaling.Invite) {
+		gameServer.Events.Publish(events.Invite, fiber.Map{
+			"invite": server.CurrentInvite(),
+			"code":   invite.Code,
+			"label":  invite.Label,
+		})
+		if invite.Label == "" {
+			gameServer.SaveState()
+		}
+	}
+	server.OnInviteRevoked = func(invite signaling.Invite) {
+		gameServer.Events.Publish(events.Invite, fiber.Map{
+			"invite":  server.CurrentInvite(),
+			"code":    invite.Code,
+			"label":   invite.Label,
+			"revoked": true,
+		})
+	}
+	server.InviteRefreshBefore = time.Duration(cfg.Signaling.InviteRefreshBefore)
+	server.OnStateChange = func(status signaling.ConnectionStatus) {
+		gameServer.Events.Publish(events.Signaling, status)
+	}
+
+	archive, err := game.NewSessionArchive(cfg.SessionsDir)
+	if err != nil {
+		fatal("Failed to open session archive", "err", err)
+	}
+	gameServer.Archive = archive
+
+	gameMode := game.Competitive
+	if cfg.Session.GameMode == "casual" {
+		gameMode = game.Casual
+	}
+	initialSession := game.GameSession{
 		SessionID:        0,
-		GameMode:         game.Competitive,
+		GameMode:         gameMode,
 		SwitchingSession: false,
 		CurrentTrack:     defaultTrack,
-		MaxPlayers:       200,
-	})
+		MaxPlayers:       cfg.Session.MaxPlayers,
+	}
 
-	if err := server.CreateInvite(); err != nil {
-		log.Fatalf("Failed to create invite: %v", err)
+	// Pick up the session of the previous process, if any
+	gameServer.StateStore = &game.StateStore{Path: cfg.StateFile}
+	state, err := gameServer.StateStore.Load()
+	if err != nil {
+		logger.Warn("Ignoring saved state", "file", cfg.StateFile, "err", err)
 	}
+	if state != nil {
+		gameServer.RestoreState(state)
+		initialSession.GameMode = state.GameMode
+		initialSession.SwitchingSession = state.SwitchingSession
+		initialSession.MaxPlayers = state.MaxPlayers
+		initialSession.CarUpdateInterval = state.CarUpdateInterval
+		initialSession.PingInterval = state.PingInterval
+		if t := findTrackByID(tracksMap, state.TrackID); t != nil {
+			initialSession.CurrentTrack = t
+		} else {
+			logger.Warn("Saved track is not loaded, using the default", "track", state.TrackName)
+		}
+	}
+
+	// Also bumps the session ID past the restored one
+	gameServer.UpdateGameSession(initialSession)
 
-	log.Println("Initial invite:", server.CurrentInvite)
+	// Connects and creates the first invite, retrying in the background if
+	// the signaling server is down
+	go server.Run()
 
 	// ---- CONTROL API ----
 
@@ -81,24 +229,25 @@ func runServer() {
 	app.Get("/status", func(c *fiber.Ctx) error {
 
 		currentName := ""
+		session := gameServer.Session()
 		currentSession, err := json.Marshal(game.GameSession{
-			SessionID:        gameServer.GameSession.SessionID,
-			GameMode:         gameServer.GameSession.GameMode,
-			SwitchingSession: gameServer.GameSession.SwitchingSession,
-			MaxPlayers:       gameServer.GameSession.MaxPlayers,
+			SessionID:        session.SessionID,
+			GameMode:         session.GameMode,
+			SwitchingSession: session.SwitchingSession,
+			MaxPlayers:       session.MaxPlayers,
 		})
 		if err != nil {
-			log.Println("Error marshalling session: " + err.Error())
+			logger.Error("Error marshalling session", "err", err)
 		}
 		for name, t := range tracksMap {
-			if t == gameServer.GameSession.CurrentTrack {
+			if t == session.CurrentTrack {
 				currentName = name
 				break
 			}
 		}
 
 		return c.JSON(fiber.Map{
-			"invite":  server.CurrentInvite,
+			"invite":  server.CurrentInvite(),
 			"tracks":  trackNames,
 			"current": currentName,
 			"session": string(currentSession),
@@ -107,12 +256,13 @@ func runServer() {
 
 	app.Post("/invite", func(c *fiber.Ctx) error {
 
-		if err := server.CreateInvite(); err != nil {
+		invite, err := requestInvite(server, "")
+		if err != nil {
 			return c.Status(500).SendString(err.Error())
 		}
 
 		return c.JSON(fiber.Map{
-			"invite": server.CurrentInvite,
+			"invite": invite.Code,
 		})
 	})
 
@@ -132,10 +282,9 @@ func runServer() {
 			return c.Status(404).SendString("Track not found")
 		}
 
-		cur := gameServer.GameSession
-		cur.CurrentTrack = t
+		gameServer.SetTrack(t)
 
-		log.Println("Track switched to", req.Name)
+		logger.Info("Track switched", "track", req.Name)
 
 		return c.SendStatus(204)
 	})
@@ -151,49 +300,26 @@ func runServer() {
 			return c.Status(400).SendString("Invalid body")
 		}
 
-		for _, player := range gameServer.Players {
-			if player.ID == req.ID {
-				log.Println("Kicked player: ", player.Nickname)
-				player.Send(gamepackets.KickPlayerPacket{})
-				for _, p := range gameServer.Players {
-					p.Send(gamepackets.RemovePlayerPacket{
-						ID:       player.ID,
-						IsKicked: true,
-					})
-				}
-				time.AfterFunc(1*time.Second, func() {
-					player.Session.Peer.Close()
-				})
-				break
-			}
-		}
+		gameServer.KickPlayer(req.ID)
 
 		return c.SendStatus(204)
 	})
 
 	app.Post("/session/end", func(c *fiber.Ctx) error {
-		if gameServer.GameSession.SwitchingSession {
-			log.Println("Can't end session, already ended.")
+		if err := gameServer.EndSession(); err != nil {
+			logger.Warn("Can't end session", "err", err)
 			return c.SendStatus(400)
 		}
-		log.Println("Ending session...")
-		gameServer.GameSession.SwitchingSession = true
-		for _, player := range gameServer.Players {
-			player.Send(gamepackets.EndSessionPacket{})
-		}
+		logger.Info("Ending session...")
 		return c.SendStatus(204)
 	})
 
 	app.Post("/session/start", func(c *fiber.Ctx) error {
-		if !gameServer.GameSession.SwitchingSession {
-			log.Println("Can't start session, already started.")
+		if err := gameServer.StartSession(); err != nil {
+			logger.Warn("Can't start session", "err", err)
 			return c.SendStatus(400)
 		}
-		log.Println("Starting session...")
-		gameServer.GameSession.SwitchingSession = false
-		for _, player := range gameServer.Players {
-			player.StartNewSession()
-		}
+		logger.Info("Starting session...")
 		return c.SendStatus(204)
 	})
 
@@ -212,17 +338,21 @@ func runServer() {
 		t, ok := tracksMap[req.Track]
 
 		if !ok {
-			log.Println("Track " + req.Track + " not found.")
+			logger.Warn("Track not found", "track", req.Track)
 			return c.SendStatus(400)
 		}
 
-		gameServer.UpdateGameSession(game.GameSession{
+		session := game.GameSession{
 			GameMode:         req.GameMode,
 			SwitchingSession: true,
 			CurrentTrack:     t,
 			MaxPlayers:       req.MaxPlayers,
-		})
-		log.Println("Got new session data...")
+		}
+		if err := validateSession(session); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		gameServer.UpdateGameSession(session)
+		logger.Info("Got new session data", "track", req.Track, "gamemode", req.GameMode, "maxPlayers", req.MaxPlayers)
 
 		return c.SendStatus(204)
 	})
@@ -230,11 +360,11 @@ func runServer() {
 	app.Get("/players", func(c *fiber.Ctx) error {
 
 		list := []fiber.Map{}
-		for _, p := range gameServer.Players {
+		for _, p := range gameServer.Players() {
 
 			timeStr := "-"
-			if p.NumberOfFrames != nil {
-				seconds := float64(*p.NumberOfFrames) / 1000.0
+			if p.Frames != nil {
+				seconds := float64(*p.Frames) / 1000.0
 				timeStr = fmt.Sprintf("%.3fs", seconds)
 			}
 
@@ -251,14 +381,346 @@ func runServer() {
 		})
 	})
 
-	addr := "127.0.0.1:" + strconv.Itoa(*controlPort)
+	// Live race ranking, also published as "standings" events
+	app.Get("/standings", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"sessionId": gameServer.Session().SessionID,
+			"standings": gameServer.Standings(),
+		})
+	})
+
+	// Server-Sent Events stream, optionally filtered with ?types=a,b
+	app.Get("/events", func(c *fiber.Ctx) error {
+
+		filter := map[string]bool{}
+		for _, t := range strings.Split(c.Query("types"), ",") {
+			if t != "" {
+				filter[t] = true
+			}
+		}
+
+		return streamEvents(c, gameServer.Events, filter)
+	})
+
+	// ---- SPECTATOR MAP ----
+
+	app.Get("/track/layout", func(c *fiber.Ctx) error {
+		track := gameServer.Session().CurrentTrack
+		if track == nil {
+			return c.Status(404).SendString("No track loaded")
+		}
+		return c.JSON(game.NewTrackLayout(track))
+	})
+
+	// Streams car positions as Server-Sent Events, ?hz= sets the rate (1-20)
+	app.Get("/spectate", func(c *fiber.Ctx) error {
+
+		hz := c.QueryInt("hz", 5)
+		if hz < 1 || hz > 20 {
+			return c.Status(400).SendString("hz must be between 1 and 20")
+		}
+
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Set("Connection", "keep-alive")
+
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			ticker := time.NewTicker(time.Second / time.Duration(hz))
+			defer ticker.Stop()
+
+			for range ticker.C {
+				data, err := json.Marshal(fiber.Map{
+					"sessionId": gameServer.Session().SessionID,
+					"cars":      gameServer.CarPositions(),
+				})
+				if err != nil {
+					logger.Error("Failed to encode positions", "err", err)
+					return
+				}
+				fmt.Fprintf(w, "event: positions\ndata: %s\n\n", data)
+				// A failed flush means the client went away
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		})
+
+		return nil
+	})
+
+	app.Get("/log/level", func(c *fiber.Ctx) error {
+		return c.JSON(logging.Levels())
+	})
+
+	app.Post("/log/level", func(c *fiber.Ctx) error {
+
+		type Req struct {
+			Subsystem string `json:"subsystem"`
+			Level     string `json:"level"`
+		}
+
+		var req Req
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).SendString("Invalid body")
+		}
+
+		if err := logging.SetLevel(req.Subsystem, req.Level); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		logger.Info("Log level changed", "subsystem", req.Subsystem, "level", req.Level)
+
+		return c.JSON(logging.Levels())
+	})
+
+	app.Get("/metrics", func(c *fiber.Ctx) error {
+		c.Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.Default.WriteText(c)
+		return nil
+	})
+
+	// ---- SESSION ARCHIVE ----
+
+	app.Get("/sessions", func(c *fiber.Ctx) error {
+		list, err := archive.List()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(fiber.Map{
+			"sessions": list,
+		})
+	})
+
+	app.Get("/sessions/:id", func(c *fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+		if err != nil {
+			return c.Status(400).SendString("Invalid session ID")
+		}
+		summary, err := archive.Get(uint32(id))
+		if err != nil {
+			return c.Status(404).SendString("Session not found")
+		}
+		return c.JSON(summary)
+	})
+
+	// ---- TOURNAMENT ----
+
+	tournaments := tournament.NewManager(cfg.TournamentFile, gameServer, tracksMap)
+
+	app.Get("/tournament", func(c *fiber.Ctx) error {
+		t := tournaments.Get()
+		if t == nil {
+			return c.Status(404).SendString("No tournament")
+		}
+		return c.JSON(t)
+	})
+
+	app.Post("/tournament", func(c *fiber.Ctx) error {
+
+		type Req struct {
+			Name     string                   `json:"name"`
+			HeatSize int                      `json:"heatSize"`
+			Rounds   []tournament.RoundConfig `json:"rounds"`
+			Players  []string                 `json:"players"`
+		}
+
+		var req Req
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).SendString("Invalid body")
+		}
+
+		if err := tournaments.Create(req.Name, req.HeatSize, req.Rounds, req.Players); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+
+		return c.JSON(tournaments.Get())
+	})
+
+	app.Post("/tournament/heat/start", func(c *fiber.Ctx) error {
+
+		type Req struct {
+			Heat int `json:"heat"`
+		}
+
+		var req Req
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).SendString("Invalid body")
+		}
+
+		if err := tournaments.StartHeat(req.Heat); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+
+		return c.JSON(tournaments.Get())
+	})
+
+	app.Post("/tournament/heat/finish", func(c *fiber.Ctx) error {
+		if err := tournaments.FinishHeat(); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+
+		return c.JSON(tournaments.Get())
+	})
+
+	app.Post("/tournament/reset", func(c *fiber.Ctx) error {
+		if err := tournaments.Reset(); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.SendStatus(204)
+	})
+
+	// POST /drain shuts the server down like SIGTERM, with an optional notice
+	drainRequests := make(chan string, 1)
+	requestDrain := func(notice string) {
+		select {
+		case drainRequests <- notice:
+		default:
+		}
+	}
+
+	app.Post("/drain", func(c *fiber.Ctx) error {
+
+		type Req struct {
+			Notice string `json:"notice"`
+		}
+
+		var req Req
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(400).SendString("Invalid body")
+			}
+		}
+
+		requestDrain(req.Notice)
+		return c.SendStatus(202)
+	})
+
+	registerAPIv1(app, &apiServer{
+		signaling:   server,
+		game:        gameServer,
+		tracks:      tracksMap,
+		trackNames:  trackNames,
+		archive:     archive,
+		tournaments: tournaments,
+		drain:       requestDrain,
+	})
+
+	apps := []*fiber.App{app}
+	if cfg.OverlayPort != 0 {
+		apps = append(apps, startOverlay(gameServer, cfg.OverlayBind+":"+strconv.Itoa(cfg.OverlayPort)))
+	}
+
+	addr := "127.0.0.1:" + strconv.Itoa(cfg.ControlPort)
 
 	go func() {
-		log.Println("Control API running on", addr)
+		logger.Info("Control API running", "addr", addr)
 		if err := app.Listen(addr); err != nil {
-			log.Println(err)
+			logger.Error("Control API stopped", "err", err)
 		}
 	}()
 
-	select {} // keep server alive
+	notice := "Server is shutting down"
+	select {
+	case <-signals.Done():
+		logger.Info("Got shutdown signal")
+	case n := <-drainRequests:
+		logger.Info("Drain requested")
+		if n != "" {
+			notice = n
+		}
+	}
+	// A second signal kills the server right away
+	stopSignals()
+
+	shutdown(gameServer, server, apps, notice, time.Duration(cfg.Timing.DrainGrace), time.Duration(cfg.Timing.ShutdownTimeout))
+	if localSignaling != nil {
+		localSignaling.Close()
+	}
+}
+
+// iceSettings turns the ICE config into peer connection settings
+func iceSettings(cfg config.ICEConfig) webrtc_session.Settings {
+	settings := webrtc_session.Settings{
+		TransportPolicy: pionwebrtc.ICETransportPolicyAll,
+		PortMin:         uint16(cfg.PortMin),
+		PortMax:         uint16(cfg.PortMax),
+		NAT1To1IPs:      cfg.PublicIPs,
+	}
+	if cfg.TransportPolicy == "relay" {
+		settings.TransportPolicy = pionwebrtc.ICETransportPolicyRelay
+	}
+	settings.NAT1To1CandidateType = pionwebrtc.ICECandidateTypeHost
+	if cfg.PublicIPCandidateType == "srflx" {
+		settings.NAT1To1CandidateType = pionwebrtc.ICECandidateTypeSrflx
+	}
+	for _, server := range cfg.Servers {
+		settings.ICEServers = append(settings.ICEServers, pionwebrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return settings
+}
+
+// streamEvents writes the events of bus as Server-Sent Events until the client
+// goes away. An empty filter lets every event type through.
+func streamEvents(c *fiber.Ctx, bus *events.Bus, filter map[string]bool) error {
+
+	ch, unsubscribe := bus.Subscribe(64)
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
+		// Tell the client it's connected before the first event
+		fmt.Fprint(w, ": connected\n\n")
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		keepAlive := time.NewTicker(15 * time.Second)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case event, ok := <-ch:
+				if !ok {
+					return
+				}
+				if len(filter) > 0 && !filter[event.Type] {
+					continue
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					logger.Error("Failed to encode event", "type", event.Type, "err", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+			// A failed flush means the client went away
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// findTrackByID returns the loaded track with the given track ID, or nil
+func findTrackByID(tracksMap map[string]*gametrack.Track, id string) *gametrack.Track {
+	if id == "" {
+		return nil
+	}
+	for _, t := range tracksMap {
+		if trackID, err := t.GetTrackID(); err == nil && trackID == id {
+			return t
+		}
+	}
+	return nil
 }
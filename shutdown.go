@@ -0,0 +1,37 @@
+package main
+
+import (
+	"polyserver/game"
+	"polyserver/signaling"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// shutdown drains the game server and stops everything in order: players get
+// the end of session, the results are archived, then connections close
+func shutdown(gameServer *game.GameServer, server *signaling.WebRTCServer, apps []*fiber.App, notice string, grace, timeout time.Duration) {
+
+	logger.Info("Shutting down", "notice", notice)
+
+	gameServer.Drain(notice)
+
+	// Give the end of session packets time to arrive
+	time.Sleep(grace)
+
+	gameServer.DisconnectAll()
+	gameServer.SaveState()
+	gameServer.Stop()
+
+	if err := server.Close(); err != nil {
+		logger.Warn("Failed to close signaling websocket", "err", err)
+	}
+
+	for _, app := range apps {
+		if err := app.ShutdownWithTimeout(timeout); err != nil {
+			logger.Warn("HTTP server did not shut down cleanly", "err", err)
+		}
+	}
+
+	logger.Info("Shutdown complete")
+}
@@ -0,0 +1,300 @@
+package signaling
+
+import (
+	"errors"
+	"polyserver/config"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// INVITES
+//
+
+var ErrInviteNotFound = errors.New("invite not found")
+
+// Invite is a code players join with. The main invite, CurrentInvite, has no
+// label; extra invites, e.g. one per streamer, are told apart by theirs.
+type Invite struct {
+	Code      string     `json:"code"`
+	Label     string     `json:"label"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt"` // null when it doesn't expire
+	Uses      int        `json:"uses"`
+}
+
+// InviteRevoker is implemented by transports whose signaling server can
+// withdraw an invite and says which code a player joined with. vps.kodub.com
+// does neither, so a revoked code stays usable there until it expires.
+type InviteRevoker interface {
+	RevokeInvite(code string) error
+}
+
+// inviteReclaimer is implemented by transports whose signaling server gives
+// a host its previous code back. vps.kodub.com isn't known to take the code,
+// so it's never sent there.
+type inviteReclaimer interface {
+	reclaimsInvites()
+}
+
+// RevokedInvite is an invite that was just revoked. Enforced is false when
+// players can still join with it: the signaling server can't withdraw the
+// code, and since joins don't say which code they used they can't be told
+// apart from joins through the invites that are left.
+type RevokedInvite struct {
+	Invite
+	Enforced bool `json:"enforced"`
+}
+
+type inviteSet struct {
+	lock sync.Mutex
+	// Code of the main invite, empty while there is none
+	current string
+	byLabel map[string]*trackedInvite
+	// createInvite answers come back in the order they were asked for
+	pending []pendingInvite
+	revoked map[string]bool
+	// The main invite was revoked, a reconnect doesn't ask for it again
+	mainRevoked bool
+	// Code the first main invite asks for, e.g. the one of the previous
+	// process
+	reclaim string
+}
+
+type trackedInvite struct {
+	Invite
+	refresh *time.Timer
+}
+
+type pendingInvite struct {
+	label string
+	done  chan Invite
+}
+
+// RequestInvite asks for a new invite under label, replacing the one it had.
+// The channel gets the invite once the signaling server answers.
+func (s *WebRTCServer) RequestInvite(label string) (<-chan Invite, error) {
+	return s.requestInvite(label, "")
+}
+
+// requestInvite asks for an invite, previous is the code to keep if the
+// signaling server allows it
+func (s *WebRTCServer) requestInvite(label, previous string) (<-chan Invite, error) {
+	done := make(chan Invite, 1)
+	s.invites.lock.Lock()
+	s.invites.pending = append(s.invites.pending, pendingInvite{label: label, done: done})
+	s.invites.lock.Unlock()
+
+	if _, ok := s.Transport.(inviteReclaimer); !ok {
+		previous = ""
+	}
+	err := s.Transport.Send(CreateInviteRequest{
+		Type:       "createInvite",
+		Version:    config.PolyVersion,
+		InviteCode: previous,
+	})
+	if err != nil {
+		s.invites.lock.Lock()
+		for i, p := range s.invites.pending {
+			if p.done == done {
+				s.invites.pending = append(s.invites.pending[:i], s.invites.pending[i+1:]...)
+				break
+			}
+		}
+		s.invites.lock.Unlock()
+		return nil, err
+	}
+	return done, nil
+}
+
+// recreateInvites asks for every invite again after a reconnect, keeping
+// their codes where the signaling server allows it
+func (s *WebRTCServer) recreateInvites() error {
+	s.invites.lock.Lock()
+	// Answers to requests on the old connection won't come
+	s.invites.pending = nil
+	codes := map[string]string{}
+	if !s.invites.mainRevoked {
+		codes[""] = s.invites.current
+		if codes[""] == "" {
+			codes[""] = s.invites.reclaim
+		}
+	}
+	for label, invite := range s.invites.byLabel {
+		codes[label] = invite.Code
+	}
+	s.invites.lock.Unlock()
+
+	for label, code := range codes {
+		if _, err := s.requestInvite(label, code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WebRTCServer) handleCreateInvite(p CreateInviteResponse) {
+	now := time.Now()
+	invite := &trackedInvite{Invite: Invite{Code: p.InviteCode, CreatedAt: now}}
+
+	s.invites.lock.Lock()
+	var done chan Invite
+	if len(s.invites.pending) > 0 {
+		invite.Label = s.invites.pending[0].label
+		done = s.invites.pending[0].done
+		s.invites.pending = s.invites.pending[1:]
+	}
+
+	old := s.invites.byLabel[invite.Label]
+	if old != nil && old.refresh != nil {
+		old.refresh.Stop()
+	}
+	if p.TimeoutMilliseconds > 0 {
+		timeout := time.Duration(p.TimeoutMilliseconds) * time.Millisecond
+		expires := now.Add(timeout)
+		invite.ExpiresAt = &expires
+		refreshIn := timeout - min(s.InviteRefreshBefore, timeout/2)
+		label, code := invite.Label, invite.Code
+		invite.refresh = time.AfterFunc(refreshIn, func() {
+			s.refreshInvite(label, code)
+		})
+	}
+	s.invites.byLabel[invite.Label] = invite
+	delete(s.invites.revoked, invite.Code)
+	if invite.Label == "" {
+		s.invites.current = invite.Code
+		s.invites.mainRevoked = false
+		s.invites.reclaim = ""
+	}
+	created := invite.Invite
+	s.invites.lock.Unlock()
+
+	if old != nil && old.Code != invite.Code {
+		logger.Info("Invite code changed", "label", invite.Label, "previous", old.Code)
+	}
+	logger.Info("Invite code", "invite", invite.Code, "label", invite.Label, "expiresAt", invite.ExpiresAt)
+	if done != nil {
+		done <- created
+	}
+	if s.OnInvite != nil {
+		s.OnInvite(created)
+	}
+}
+
+// refreshInvite replaces an invite that's about to expire, unless it was
+// revoked or replaced in the meantime
+func (s *WebRTCServer) refreshInvite(label, code string) {
+	s.invites.lock.Lock()
+	current := s.invites.byLabel[label]
+	s.invites.lock.Unlock()
+	if current == nil || current.Code != code || s.closed.Load() {
+		return
+	}
+
+	logger.Info("Refreshing invite before it expires", "invite", code, "label", label)
+	if _, err := s.requestInvite(label, ""); err != nil {
+		// The reconnect asks for it again
+		logger.Warn("Failed to refresh invite", "invite", code, "err", err)
+	}
+}
+
+// RevokeInvite stops tracking the invite with the given code or label and
+// refuses players joining with it, as far as the signaling server allows
+func (s *WebRTCServer) RevokeInvite(codeOrLabel string) (RevokedInvite, error) {
+	s.invites.lock.Lock()
+	invite := s.invites.byLabel[codeOrLabel]
+	if invite == nil {
+		for _, i := range s.invites.byLabel {
+			if i.Code == codeOrLabel {
+				invite = i
+				break
+			}
+		}
+	}
+	if invite == nil {
+		s.invites.lock.Unlock()
+		return RevokedInvite{}, ErrInviteNotFound
+	}
+	if invite.refresh != nil {
+		invite.refresh.Stop()
+	}
+	delete(s.invites.byLabel, invite.Label)
+	s.invites.revoked[invite.Code] = true
+	if invite.Label == "" {
+		s.invites.current = ""
+		s.invites.mainRevoked = true
+	}
+	// Joins without a code are refused once no invite is left
+	revoked := RevokedInvite{Invite: invite.Invite, Enforced: len(s.invites.byLabel) == 0}
+	s.invites.lock.Unlock()
+
+	logger.Info("Revoked invite", "invite", invite.Code, "label", invite.Label)
+	if revoker, ok := s.Transport.(InviteRevoker); ok {
+		revoked.Enforced = true
+		if err := revoker.RevokeInvite(invite.Code); err != nil {
+			logger.Warn("Signaling server failed to revoke invite", "invite", invite.Code, "err", err)
+		}
+	}
+	if !revoked.Enforced {
+		logger.Warn("Signaling server can't withdraw the invite, players can still join with it while other invites are open", "invite", invite.Code)
+	}
+	if s.OnInviteRevoked != nil {
+		s.OnInviteRevoked(invite.Invite)
+	}
+	return revoked, nil
+}
+
+// ReclaimInvite makes the first main invite ask for code instead of a new
+// one, where the signaling server allows it
+func (s *WebRTCServer) ReclaimInvite(code string) {
+	s.invites.lock.Lock()
+	defer s.invites.lock.Unlock()
+	s.invites.reclaim = code
+}
+
+// CurrentInvite returns the code of the main invite, empty while there is
+// none
+func (s *WebRTCServer) CurrentInvite() string {
+	s.invites.lock.Lock()
+	defer s.invites.lock.Unlock()
+	return s.invites.current
+}
+
+// Invites returns every tracked invite, the main one first
+func (s *WebRTCServer) Invites() []Invite {
+	s.invites.lock.Lock()
+	defer s.invites.lock.Unlock()
+	invites := make([]Invite, 0, len(s.invites.byLabel))
+	for _, invite := range s.invites.byLabel {
+		invites = append(invites, invite.Invite)
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].Label < invites[j].Label
+	})
+	return invites
+}
+
+// useInvite counts a join and reports whether it's allowed. Joins that don't
+// say which code they used are counted for the main invite, and refused once
+// every invite was revoked.
+func (s *WebRTCServer) useInvite(code string) bool {
+	s.invites.lock.Lock()
+	defer s.invites.lock.Unlock()
+	if code == "" {
+		if len(s.invites.byLabel) == 0 {
+			return false
+		}
+		code = s.invites.current
+	}
+	if s.invites.revoked[code] {
+		return false
+	}
+	for _, invite := range s.invites.byLabel {
+		if invite.Code == code {
+			invite.Uses++
+			break
+		}
+	}
+	return true
+}
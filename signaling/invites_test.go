@@ -0,0 +1,100 @@
+package signaling
+
+import (
+	"testing"
+	"time"
+)
+
+func createInvite(t *testing.T, server *WebRTCServer, label string) Invite {
+	t.Helper()
+	created, err := server.RequestInvite(label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case invite := <-created:
+		return invite
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no invite created for %q", label)
+		return Invite{}
+	}
+}
+
+// The loopback can't withdraw codes and its joins carry none, like
+// vps.kodub.com
+func TestRevokeInviteWithoutCodes(t *testing.T) {
+	server, loopback := newLoopbackServer(t)
+	main := createInvite(t, server, "")
+	createInvite(t, server, "alice")
+
+	revoked, err := server.RevokeInvite(main.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked.Enforced {
+		t.Fatal("revoking the main invite is enforced while another one is open")
+	}
+	if !server.useInvite("") {
+		t.Fatal("join refused while another invite is open")
+	}
+
+	// A reconnect only asks for the invite that's left
+	if err := server.recreateInvites(); err != nil {
+		t.Fatal(err)
+	}
+	invite := createInvite(t, server, "bob")
+	if got := server.CurrentInvite(); got != "" {
+		t.Fatalf("revoked main invite came back as %q", got)
+	}
+	for _, i := range server.Invites() {
+		if i.Label == "" {
+			t.Fatalf("revoked main invite came back as %q", i.Code)
+		}
+	}
+
+	if _, err := server.RevokeInvite("alice"); err != nil {
+		t.Fatal(err)
+	}
+	revoked, err = server.RevokeInvite(invite.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked.Enforced {
+		t.Fatal("revoking the last invite isn't enforced")
+	}
+	if server.useInvite("") {
+		t.Fatal("join accepted with every invite revoked")
+	}
+	select {
+	case msg := <-loopback.Outbox:
+		t.Fatalf("unexpected %s packet", msg.MessageType())
+	default:
+	}
+}
+
+// Refreshed codes that nobody joins with don't stay in the local server
+func TestLocalServerDropsExpiredInvites(t *testing.T) {
+	local := NewLocalServer()
+	local.InviteTimeout = 10 * time.Millisecond
+	transport := local.HostTransport()
+	if err := transport.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	for range 3 {
+		if err := transport.Send(CreateInviteRequest{Type: "createInvite"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := transport.Receive(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	local.lock.Lock()
+	defer local.lock.Unlock()
+	if len(local.invites) != 1 {
+		t.Errorf("%d invites kept, want 1", len(local.invites))
+	}
+}
@@ -0,0 +1,425 @@
+package signaling
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+//
+// LOCAL SIGNALING SERVER
+//
+
+// LocalServer is a built-in signaling server speaking the same protocol as
+// vps.kodub.com, for LAN events and offline testing. Hosts connect to
+// /<api>/multiplayer/host, or in-process through HostTransport, and create
+// invites; players connect to /<api>/multiplayer/join and send a joinInvite
+// with the invite code, then offers, answers and ICE candidates are relayed
+// between them.
+type LocalServer struct {
+	// Invites expire after this long, 0 keeps them until the host leaves
+	InviteTimeout time.Duration
+
+	lock    sync.Mutex
+	invites map[string]*localInvite
+	server  *http.Server
+}
+
+type localInvite struct {
+	host      *localHost
+	expiresAt time.Time // zero when it doesn't expire
+}
+
+type localHost struct {
+	send    func(Message) error
+	clients map[string]*localConn
+	invites []string
+}
+
+type localConn struct {
+	conn *websocket.Conn
+	lock sync.Mutex
+}
+
+func (c *localConn) send(v Message) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// ClientIceCandidate is an ICE candidate sent by a player, the server adds
+// the session before passing it to the host. Candidates sent before the
+// joinInvite are held until it arrives.
+type ClientIceCandidate struct {
+	Type      string                  `json:"type"`
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
+}
+
+var upgrader = websocket.Upgrader{
+	// Game clients connect from any origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func NewLocalServer() *LocalServer {
+	return &LocalServer{invites: map[string]*localInvite{}}
+}
+
+// Start listens on addr and serves in the background
+func (l *LocalServer) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/multiplayer/host"):
+			l.serveHost(w, r)
+		case strings.HasSuffix(r.URL.Path, "/multiplayer/join"):
+			l.serveClient(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	l.server = &http.Server{Handler: mux}
+
+	logger.Info("Local signaling server listening", "addr", listener.Addr().String())
+	go func() {
+		if err := l.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Local signaling server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// Close stops listening. Hijacked websockets aren't tracked by http.Server,
+// the hosts and players notice when their peer goes away.
+func (l *LocalServer) Close() error {
+	if l.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return l.server.Shutdown(ctx)
+}
+
+func (l *LocalServer) serveHost(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := &localConn{conn: ws}
+	host := l.addHost(conn.send)
+	logger.Debug("Host connected to local signaling", "remote", ws.RemoteAddr().String())
+
+	defer func() {
+		l.removeHost(host)
+		ws.Close()
+		logger.Debug("Host left local signaling")
+	}()
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, err := decodeFromHost(data)
+		if err != nil {
+			continue
+		}
+		l.fromHost(host, msg)
+	}
+}
+
+func (l *LocalServer) addHost(send func(Message) error) *localHost {
+	return &localHost{send: send, clients: map[string]*localConn{}}
+}
+
+// deleteInvite drops an invite, l.lock must be held
+func (l *LocalServer) deleteInvite(code string) {
+	invite := l.invites[code]
+	if invite == nil {
+		return
+	}
+	delete(l.invites, code)
+	codes := invite.host.invites
+	for i, c := range codes {
+		if c == code {
+			invite.host.invites = append(codes[:i:i], codes[i+1:]...)
+			break
+		}
+	}
+}
+
+// deleteExpired drops the invites that timed out, l.lock must be held. Joins
+// only check the code they use, so refreshed codes would pile up otherwise.
+func (l *LocalServer) deleteExpired() {
+	now := time.Now()
+	for code, invite := range l.invites {
+		if !invite.expiresAt.IsZero() && now.After(invite.expiresAt) {
+			l.deleteInvite(code)
+		}
+	}
+}
+
+// removeHost drops the invites of host and disconnects its players
+func (l *LocalServer) removeHost(host *localHost) {
+	l.lock.Lock()
+	for _, code := range host.invites {
+		delete(l.invites, code)
+	}
+	host.invites = nil
+	clients := host.clients
+	host.clients = map[string]*localConn{}
+	l.lock.Unlock()
+	for _, client := range clients {
+		client.conn.Close()
+	}
+}
+
+// fromHost handles a packet sent by a host
+func (l *LocalServer) fromHost(host *localHost, msg Message) error {
+	var session string
+	switch p := msg.(type) {
+	case CreateInviteRequest:
+		l.lock.Lock()
+		l.deleteExpired()
+		// A reconnecting host gets its old code back if nobody took it
+		code := strings.ToUpper(p.InviteCode)
+		if _, taken := l.invites[code]; code == "" || taken {
+			code = inviteCode()
+		}
+		invite := &localInvite{host: host}
+		if l.InviteTimeout > 0 {
+			invite.expiresAt = time.Now().Add(l.InviteTimeout)
+		}
+		l.invites[code] = invite
+		host.invites = append(host.invites, code)
+		l.lock.Unlock()
+		return host.send(CreateInviteResponse{
+			Type:                "createInvite",
+			InviteCode:          code,
+			TimeoutMilliseconds: int(l.InviteTimeout.Milliseconds()),
+		})
+	case AcceptJoinPacket:
+		session = p.Session
+	case IceCandidatePacket:
+		session = p.Session
+	default:
+		return nil
+	}
+
+	l.lock.Lock()
+	client := host.clients[session]
+	l.lock.Unlock()
+	if client == nil {
+		return nil
+	}
+	return client.send(msg)
+}
+
+func (l *LocalServer) serveClient(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	client := &localConn{conn: ws}
+	session := sessionID()
+
+	var host *localHost
+	defer func() {
+		if host != nil {
+			l.lock.Lock()
+			delete(host.clients, session)
+			l.lock.Unlock()
+		}
+	}()
+
+	// Candidates gathered before the join are held until the host is known
+	var pending []webrtc.ICECandidateInit
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var env WebsocketResponse
+		if err := json.Unmarshal(message, &env); err != nil {
+			continue
+		}
+
+		switch env.Type {
+		case "joinInvite":
+			if host != nil {
+				continue
+			}
+			var join JoinInvite
+			json.Unmarshal(message, &join)
+			join.InviteCode = strings.ToUpper(join.InviteCode)
+
+			l.lock.Lock()
+			invite := l.invites[join.InviteCode]
+			if invite != nil && !invite.expiresAt.IsZero() && time.Now().After(invite.expiresAt) {
+				l.deleteInvite(join.InviteCode)
+				invite = nil
+			}
+			if invite != nil {
+				host = invite.host
+				host.clients[session] = client
+			}
+			l.lock.Unlock()
+			if host == nil {
+				client.send(ErrorPacket{Type: "error", Message: "unknown or expired invite"})
+				return
+			}
+
+			join.Session = session
+			if err := host.send(join); err != nil {
+				return
+			}
+			for _, candidate := range pending {
+				host.send(clientCandidate(session, candidate))
+			}
+			pending = nil
+
+		case "iceCandidate":
+			var candidate ClientIceCandidate
+			json.Unmarshal(message, &candidate)
+			if host == nil {
+				pending = append(pending, candidate.Candidate)
+				continue
+			}
+			host.send(clientCandidate(session, candidate.Candidate))
+		}
+	}
+}
+
+func clientCandidate(session string, candidate webrtc.ICECandidateInit) IceCandidateResponse {
+	return IceCandidateResponse{
+		Type:      "iceCandidate",
+		Session:   session,
+		Candidate: candidate,
+	}
+}
+
+//
+// IN-PROCESS HOST
+//
+
+// HostTransport connects a host running in the same process, without going
+// through a websocket
+func (l *LocalServer) HostTransport() Transport {
+	return &localHostTransport{server: l}
+}
+
+type localHostTransport struct {
+	server *LocalServer
+	lock   sync.Mutex
+	host   *localHost
+	inbox  chan Message
+	closed chan struct{}
+}
+
+// Connect registers a new host, the invites of the previous one are dropped
+func (t *localHostTransport) Connect() error {
+	t.Close()
+
+	inbox := make(chan Message, 64)
+	closed := make(chan struct{})
+	host := t.server.addHost(func(msg Message) error {
+		select {
+		case inbox <- msg:
+			return nil
+		case <-closed:
+			return net.ErrClosed
+		}
+	})
+
+	t.lock.Lock()
+	t.host, t.inbox, t.closed = host, inbox, closed
+	t.lock.Unlock()
+	return nil
+}
+
+func (t *localHostTransport) Send(msg Message) error {
+	t.lock.Lock()
+	host := t.host
+	t.lock.Unlock()
+	if host == nil {
+		return net.ErrClosed
+	}
+	return t.server.fromHost(host, msg)
+}
+
+func (t *localHostTransport) Receive() (Message, error) {
+	t.lock.Lock()
+	inbox, closed := t.inbox, t.closed
+	t.lock.Unlock()
+	if inbox == nil {
+		return nil, net.ErrClosed
+	}
+	select {
+	case msg := <-inbox:
+		return msg, nil
+	case <-closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *localHostTransport) RevokeInvite(code string) error {
+	t.lock.Lock()
+	host := t.host
+	t.lock.Unlock()
+
+	t.server.lock.Lock()
+	defer t.server.lock.Unlock()
+	if invite := t.server.invites[code]; invite != nil && invite.host == host {
+		t.server.deleteInvite(code)
+	}
+	t.server.deleteExpired()
+	return nil
+}
+
+func (t *localHostTransport) reclaimsInvites() {}
+
+func (t *localHostTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.host == nil {
+		return nil
+	}
+	t.server.removeHost(t.host)
+	close(t.closed)
+	t.host = nil
+	return nil
+}
+
+const inviteAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func inviteCode() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	for i := range b {
+		b[i] = inviteAlphabet[int(b[i])%len(inviteAlphabet)]
+	}
+	return string(b)
+}
+
+func sessionID() string {
+	return rand.Text()
+}
@@ -0,0 +1,5 @@
+package signaling
+
+import "polyserver/metrics"
+
+var reconnects = metrics.NewCounter("polyserver_signaling_reconnects_total", "Reconnects to the signaling server.")
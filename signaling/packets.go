@@ -2,10 +2,23 @@ package signaling
 
 import "github.com/pion/webrtc/v4"
 
+// Message is a typed signaling packet, sent and received through a Transport
+type Message interface {
+	MessageType() string
+}
+
 type WebsocketResponse struct {
 	Type string `json:"type"`
 }
 
+type CreateInviteRequest struct {
+	Type    string `json:"type"`
+	Version string `json:"version"`
+	// Code to keep after a reconnect, only sent to the local server. It
+	// reuses the code when it's free.
+	InviteCode string `json:"inviteCode,omitempty"`
+}
+
 type CreateInviteResponse struct {
 	Type                string `json:"type"`
 	InviteCode          string `json:"inviteCode"`
@@ -22,6 +35,8 @@ type JoinInvite struct {
 	IsModsVanillaCompatible bool     `json:"isModsVanillaCompatible"`
 	CountryCode             *string  `json:"countryCode"`
 	CarStyle                string   `json:"carStyle"`
+	// Code the player joined with, only sent by the local signaling server
+	InviteCode string `json:"inviteCode,omitempty"`
 }
 
 type AcceptJoinPacket struct {
@@ -34,6 +49,12 @@ type AcceptJoinPacket struct {
 	Answer                  string   `json:"answer"`
 }
 
+// ErrorPacket tells a player why the local signaling server turned them away
+type ErrorPacket struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
 type IceServerResponse struct {
 	Urls string `json:"urls"`
 }
@@ -57,3 +78,11 @@ type IceCandidateResponse struct {
 	Session   string                  `json:"session"`
 	Candidate webrtc.ICECandidateInit `json:"candidate"`
 }
+
+func (CreateInviteRequest) MessageType() string  { return "createInvite" }
+func (CreateInviteResponse) MessageType() string { return "createInvite" }
+func (JoinInvite) MessageType() string           { return "joinInvite" }
+func (AcceptJoinPacket) MessageType() string     { return "acceptJoin" }
+func (IceCandidatePacket) MessageType() string   { return "iceCandidate" }
+func (IceCandidateResponse) MessageType() string { return "iceCandidate" }
+func (ErrorPacket) MessageType() string          { return "error" }
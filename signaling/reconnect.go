@@ -0,0 +1,150 @@
+package signaling
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+type ConnectionState string
+
+const (
+	StateConnecting   ConnectionState = "connecting"
+	StateConnected    ConnectionState = "connected"
+	StateReconnecting ConnectionState = "reconnecting"
+	// Out of reconnect attempts, Retry starts over
+	StateFailed ConnectionState = "failed"
+)
+
+// ReconnectPolicy decides how often a lost signaling connection is retried
+type ReconnectPolicy struct {
+	Backoff     time.Duration // delay before the first attempt, doubled after each failure
+	MaxBackoff  time.Duration
+	MaxAttempts int // 0 retries forever
+}
+
+var DefaultReconnectPolicy = ReconnectPolicy{
+	Backoff:    time.Second,
+	MaxBackoff: 30 * time.Second,
+}
+
+type ConnectionStatus struct {
+	State     ConnectionState `json:"state"`
+	Since     time.Time       `json:"since"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError,omitempty"`
+	Invite    string          `json:"invite"`
+}
+
+// Status returns the state of the signaling connection
+func (s *WebRTCServer) Status() ConnectionStatus {
+	invite := s.CurrentInvite()
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	status := s.status
+	status.Invite = invite
+	return status
+}
+
+func (s *WebRTCServer) setState(state ConnectionState, attempts int, err error) {
+	s.statusLock.Lock()
+	s.status = ConnectionStatus{
+		State:    state,
+		Since:    time.Now(),
+		Attempts: attempts,
+	}
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+	s.statusLock.Unlock()
+
+	if s.OnStateChange != nil {
+		s.OnStateChange(s.Status())
+	}
+}
+
+// Run connects, asks for the first invite and handles signaling packets until
+// Close. A lost connection is retried with backoff, players that already
+// joined aren't affected.
+func (s *WebRTCServer) Run() {
+	s.setState(StateConnecting, 0, nil)
+	err := s.Connect()
+	if err == nil {
+		err = s.CreateInvite()
+	}
+	if err != nil {
+		logger.Warn("Failed to connect to signaling server", "err", err)
+		if !s.reconnect(err) {
+			return
+		}
+	} else {
+		s.setState(StateConnected, 0, nil)
+	}
+	s.Start()
+}
+
+// Retry starts reconnecting again after the server gave up
+func (s *WebRTCServer) Retry() error {
+	s.statusLock.Lock()
+	state := s.status.State
+	if state == StateFailed {
+		s.status.State = StateReconnecting
+	}
+	s.statusLock.Unlock()
+	if state != StateFailed {
+		return fmt.Errorf("signaling is %s", state)
+	}
+	go func() {
+		if s.reconnect(errors.New("manual retry")) {
+			s.Start()
+		}
+	}()
+	return nil
+}
+
+// reconnect retries the connection until it works, the server is closed or
+// the policy runs out of attempts. The old invite codes are asked for again
+// so invites that were handed out keep working where the signaling server
+// allows it.
+func (s *WebRTCServer) reconnect(cause error) bool {
+	reconnects.Inc()
+	s.setState(StateReconnecting, 0, cause)
+
+	policy := s.Reconnect
+	backoff := policy.Backoff
+
+	for attempt := 1; ; attempt++ {
+		// Full jitter on the upper half so many servers don't retry in step
+		delay := backoff/2 + rand.N(backoff/2+1)
+		logger.Info("Reconnecting to signaling server", "attempt", attempt, "in", delay.Round(time.Millisecond))
+
+		select {
+		case <-s.done:
+			return false
+		case <-time.After(delay):
+		}
+
+		err := s.Connect()
+		if err == nil {
+			err = s.recreateInvites()
+		}
+		if err == nil {
+			logger.Info("Reconnected to signaling server", "attempts", attempt)
+			s.setState(StateConnected, attempt, nil)
+			return true
+		}
+		if s.closed.Load() {
+			return false
+		}
+
+		logger.Warn("Signaling reconnect failed", "attempt", attempt, "err", err)
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			logger.Error("Giving up on the signaling server, players can't join until it's retried", "attempts", attempt)
+			s.setState(StateFailed, attempt, err)
+			return false
+		}
+		s.setState(StateReconnecting, attempt, err)
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
@@ -1,32 +1,15 @@
 package signaling
 
-import (
-	"encoding/json"
-	"log"
-)
+func (s *WebRTCServer) route(msg Message) {
+	switch packet := msg.(type) {
 
-func (s *WebRTCServer) route(message []byte) {
-	var env WebsocketResponse
-	if err := json.Unmarshal(message, &env); err != nil {
-		log.Println("invalid packet:", err)
-		return
-	}
-
-	switch env.Type {
-
-	case "createInvite":
-		var packet CreateInviteResponse
-		json.Unmarshal(message, &packet)
+	case CreateInviteResponse:
 		s.handleCreateInvite(packet)
 
-	case "joinInvite":
-		var packet JoinInvite
-		json.Unmarshal(message, &packet)
+	case JoinInvite:
 		s.handleJoinInvite(packet)
 
-	case "iceCandidate":
-		var packet IceCandidateResponse
-		json.Unmarshal(message, &packet)
+	case IceCandidateResponse:
 		s.handleICE(packet)
 	}
 }
@@ -4,124 +4,122 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"polyserver/config"
+	"polyserver/logging"
 	webrtc_session "polyserver/webrtc"
-	"strconv"
 	"sync"
-
-	"github.com/gorilla/websocket"
+	"sync/atomic"
+	"time"
 )
 
+var logger = logging.For("signaling")
+
 type WebRTCServer struct {
-	Conn          *websocket.Conn
-	ConnLock      sync.Mutex
-	ICEUrls       []string
-	CurrentInvite string
-	SessionLock   sync.Mutex
-	Sessions      map[string]*webrtc_session.PeerSession
-	ClientCount   uint32
-
-	OnOpen  func(joinPacket JoinInvite, session *webrtc_session.PeerSession)
+	Transport   Transport
+	Peers       *webrtc_session.Peers
+	SessionLock sync.Mutex
+	Sessions    map[string]*webrtc_session.PeerSession
+	ClientCount uint32
+	refuseJoins atomic.Bool
+	closed      atomic.Bool
+	done        chan struct{}
+
+	Reconnect  ReconnectPolicy
+	statusLock sync.Mutex
+	status     ConnectionStatus
+
+	OnOpen  func(clientID uint32, joinPacket JoinInvite, session *webrtc_session.PeerSession)
 	OnClose func(sessionId string)
-}
+	invites inviteSet
+	// Invites are refreshed this long before they expire
+	InviteRefreshBefore time.Duration
 
-func NewServer() *WebRTCServer {
+	OnInvite        func(invite Invite)
+	OnInviteRevoked func(invite Invite)
+	OnStateChange   func(status ConnectionStatus)
+}
 
-	resp, err := http.Get(config.IceFetchUrl)
+// FetchICEServers gets the ICE server URLs handed out by the signaling server
+func FetchICEServers(url string) ([]string, error) {
+	resp, err := http.Get(url)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	var IceServers []IceServerResponse
-	err1 := json.Unmarshal(body, &IceServers)
-	if err1 != nil {
-		log.Fatalln("Failed: Invalid ICE server response.")
+	var iceServers []IceServerResponse
+	if err := json.Unmarshal(body, &iceServers); err != nil {
+		return nil, fmt.Errorf("invalid ICE server response: %w", err)
 	}
-	var IceUrls []string
-	var numOfUrls = 0
-	for _, urls := range IceServers {
-		IceUrls = append(IceUrls, urls.Urls)
-		numOfUrls++
+	var urls []string
+	for _, server := range iceServers {
+		urls = append(urls, server.Urls)
 	}
-	log.Println("Got " + strconv.Itoa(numOfUrls) + " ICE URLs")
+	return urls, nil
+}
+
+// NewServer creates a server reaching players through transport and
+// connecting to them with peers
+func NewServer(transport Transport, peers *webrtc_session.Peers) *WebRTCServer {
 	return &WebRTCServer{
+		Transport:   transport,
 		Sessions:    make(map[string]*webrtc_session.PeerSession),
 		ClientCount: 1,
-		ICEUrls:     IceUrls,
+		Peers:       peers,
+		done:        make(chan struct{}),
+		Reconnect:   DefaultReconnectPolicy,
+		invites: inviteSet{
+			byLabel: map[string]*trackedInvite{},
+			revoked: map[string]bool{},
+		},
+		InviteRefreshBefore: 30 * time.Second,
 	}
 }
 
 func (s *WebRTCServer) Connect() error {
-	if s.Conn != nil {
-		s.Conn.Close()
-	}
-
-	conn, _, err := websocket.DefaultDialer.Dial(config.WebsocketUrl, nil)
-	if err != nil {
-		return err
-	}
-
-	s.Conn = conn
-	return nil
-}
-
-func (s *WebRTCServer) RegenerateInvite() error {
-	if err := s.Connect(); err != nil {
-		return err
-	}
-
-	go s.Start()
-
-	return s.CreateInvite()
+	return s.Transport.Connect()
 }
 
+// CreateInvite asks for a new main invite, or for the one passed to
+// ReclaimInvite. CurrentInvite returns it once the signaling server answers.
 func (s *WebRTCServer) CreateInvite() error {
-	if s.Conn == nil {
-		return fmt.Errorf("not connected")
-	}
-
-	payload := map[string]interface{}{
-		"version": config.PolyVersion,
-		"type":    "createInvite",
-	}
-
-	data, _ := json.Marshal(payload)
-
-	return s.Conn.WriteMessage(websocket.TextMessage, data)
+	s.invites.lock.Lock()
+	previous := s.invites.reclaim
+	s.invites.lock.Unlock()
+	_, err := s.requestInvite("", previous)
+	return err
 }
 
+// Start handles signaling packets until Close, reconnecting when the
+// connection is lost. It returns if reconnecting fails for good.
 func (s *WebRTCServer) Start() {
 	for {
-		_, message, err := s.Conn.ReadMessage()
+		msg, err := s.Transport.Receive()
 		if err != nil {
-			log.Println("read error:", err)
-			err := s.RegenerateInvite()
-			if err != nil {
-				log.Panicln("Unable to restart ws: " + err.Error())
+			if s.closed.Load() {
+				return
+			}
+			logger.Warn("Signaling connection lost", "err", err)
+			if !s.reconnect(err) {
+				return
 			}
-			return
+			continue
 		}
 
-		s.route(message)
+		s.route(msg)
 	}
 }
 
-func (s *WebRTCServer) handleCreateInvite(p CreateInviteResponse) {
-	s.CurrentInvite = p.InviteCode
-	log.Println("Invite code:", p.InviteCode)
-}
-
 func (s *WebRTCServer) onConnectionClosed(sessionId string) {
 	s.SessionLock.Lock()
 	defer s.SessionLock.Unlock()
 	for k := range s.Sessions {
 		if k == sessionId {
-			log.Printf("Removing %v from Sessions...\n", sessionId)
+			logger.Info("Removing session", "session", sessionId)
 			s.OnClose(sessionId)
 			delete(s.Sessions, k)
 			break
@@ -129,18 +127,40 @@ func (s *WebRTCServer) onConnectionClosed(sessionId string) {
 	}
 }
 
+// StopAccepting makes the server ignore new join requests
+func (s *WebRTCServer) StopAccepting() {
+	s.refuseJoins.Store(true)
+}
+
+// Close disconnects from the signaling server without reconnecting
+func (s *WebRTCServer) Close() error {
+	if s.closed.Swap(true) {
+		return nil
+	}
+	close(s.done)
+	return s.Transport.Close()
+}
+
 func (s *WebRTCServer) handleJoinInvite(p JoinInvite) {
-	log.Println("User is joining:", p.Nickname)
+	if s.refuseJoins.Load() {
+		logger.Info("Ignoring join while draining", "nickname", p.Nickname, "session", p.Session)
+		return
+	}
+	if !s.useInvite(p.InviteCode) {
+		logger.Info("Ignoring join with a revoked invite", "nickname", p.Nickname, "invite", p.InviteCode)
+		return
+	}
+	logger.Info("User is joining", "nickname", p.Nickname, "session", p.Session)
 
 	session, answer, err := webrtc_session.NewPeerSession(
+		s.Peers,
 		p.Session,
 		p.Offer,
 		s.OnIceCandidateServer,
-		s.ICEUrls,
 		s.onConnectionClosed,
 	)
 	if err != nil {
-		log.Println("failed to create session:", err)
+		logger.Error("Failed to create session", "session", p.Session, "err", err)
 		return
 	}
 
@@ -148,24 +168,25 @@ func (s *WebRTCServer) handleJoinInvite(p JoinInvite) {
 	s.Sessions[p.Session] = session
 	s.SessionLock.Unlock()
 
+	clientID := s.ClientCount
+	s.ClientCount++
 	session.ReliableDC.OnOpen(func() {
-		s.OnOpen(p, session)
+		s.OnOpen(clientID, p, session)
 	})
 
-	log.Println("Created session:", p.Session)
-	joinPacket, _ := json.Marshal(AcceptJoinPacket{
+	logger.Debug("Created session", "session", p.Session)
+	joinPacket := AcceptJoinPacket{
 		Type:                    "acceptJoin",
 		Version:                 config.PolyVersion,
 		Session:                 p.Session,
-		Mods:                    config.LoadedMods,
-		IsModsVanillaCompatible: config.AcceptVanillaClients,
-		CliendId:                s.ClientCount,
+		Mods:                    config.Current().Mods,
+		IsModsVanillaCompatible: config.Current().AcceptVanillaClients,
+		CliendId:                clientID,
 		Answer:                  answer,
-	})
-	s.ClientCount++
-	log.Println("Answering...")
+	}
+	logger.Debug("Answering", "session", p.Session)
 
-	s.send([]byte(joinPacket))
+	s.Transport.Send(joinPacket)
 }
 
 func (s *WebRTCServer) handleICE(p IceCandidateResponse) {
@@ -174,13 +195,13 @@ func (s *WebRTCServer) handleICE(p IceCandidateResponse) {
 	s.SessionLock.Unlock()
 
 	if !ok {
-		log.Println("unknown session:", p.Session)
+		logger.Warn("ICE candidate for unknown session", "session", p.Session)
 		return
 	}
 
 	err := session.AddICECandidate(p.Candidate)
 	if err != nil {
-		log.Println("failed to add ICE:", err)
+		logger.Warn("Failed to add ICE candidate", "session", p.Session, "err", err)
 	}
 }
 
@@ -190,20 +211,10 @@ func (s *WebRTCServer) OnIceCandidateServer(candidate []byte, session string) er
 	if err != nil {
 		return err
 	}
-	icePacket, err := json.Marshal(IceCandidatePacket{
+	return s.Transport.Send(IceCandidatePacket{
 		Type:      "iceCandidate",
 		Candidate: iceCandidate,
 		Version:   config.PolyVersion,
 		Session:   session,
 	})
-	if err != nil {
-		return err
-	}
-	return s.send(icePacket)
-}
-
-func (s *WebRTCServer) send(data []byte) error {
-	s.ConnLock.Lock()
-	defer s.ConnLock.Unlock()
-	return s.Conn.WriteMessage(1, data)
 }
@@ -0,0 +1,144 @@
+package signaling
+
+import (
+	webrtc_session "polyserver/webrtc"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// newLoopbackServer starts a server handling packets from a Loopback
+func newLoopbackServer(t *testing.T) (*WebRTCServer, *Loopback) {
+	t.Helper()
+	peers, err := webrtc_session.NewPeers(webrtc_session.Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loopback := NewLoopback()
+	server := NewServer(loopback, peers)
+	server.OnOpen = func(uint32, JoinInvite, *webrtc_session.PeerSession) {}
+	server.OnClose = func(string) {}
+	if err := server.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+	t.Cleanup(func() { server.Close() })
+	return server, loopback
+}
+
+// newPlayerPeer makes a peer connection with the game's negotiated data
+// channels and returns its offer
+func newPlayerPeer(t *testing.T) (*webrtc.PeerConnection, *webrtc.DataChannel, string) {
+	t.Helper()
+	peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	negotiated := true
+	id := uint16(0)
+	reliable, err := peer.CreateDataChannel("reliable", &webrtc.DataChannelInit{Negotiated: &negotiated, ID: &id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := peer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	return peer, reliable, offer.SDP
+}
+
+func TestLoopbackJoin(t *testing.T) {
+	server, loopback := newLoopbackServer(t)
+
+	opened := make(chan uint32, 1)
+	server.OnOpen = func(clientID uint32, join JoinInvite, session *webrtc_session.PeerSession) {
+		if join.Nickname != "tester" {
+			t.Errorf("joined as %q, want tester", join.Nickname)
+		}
+		opened <- clientID
+	}
+
+	created, err := server.RequestInvite("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case invite := <-created:
+		if invite.Code == "" || server.CurrentInvite() != invite.Code {
+			t.Fatalf("current invite is %q, created %q", server.CurrentInvite(), invite.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no invite created")
+	}
+
+	peer, reliable, offer := newPlayerPeer(t)
+	playerOpen := make(chan struct{})
+	reliable.OnOpen(func() { close(playerOpen) })
+	peer.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			loopback.Candidate(IceCandidateResponse{Session: "s1", Candidate: c.ToJSON()})
+		}
+	})
+	if err := loopback.Join(JoinInvite{Session: "s1", Offer: offer, Nickname: "tester"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The host's candidates may come before its answer
+	var candidates []webrtc.ICECandidateInit
+	answered := false
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-loopback.Outbox:
+			switch packet := msg.(type) {
+			case AcceptJoinPacket:
+				if packet.Session != "s1" || packet.CliendId != 1 {
+					t.Fatalf("accepted session %q as client %d", packet.Session, packet.CliendId)
+				}
+				err := peer.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: packet.Answer})
+				if err != nil {
+					t.Fatal(err)
+				}
+				answered = true
+			case IceCandidatePacket:
+				candidates = append(candidates, webrtc.ICECandidateInit{
+					Candidate:        packet.Candidate.Candidate,
+					SDPMid:           packet.Candidate.SDPMid,
+					SDPMLineIndex:    packet.Candidate.SDPMLineIndex,
+					UsernameFragment: packet.Candidate.UsernameFragment,
+				})
+			default:
+				t.Fatalf("unexpected %s packet", msg.MessageType())
+			}
+			if answered {
+				for _, candidate := range candidates {
+					if err := peer.AddICECandidate(candidate); err != nil {
+						t.Fatal(err)
+					}
+				}
+				candidates = nil
+			}
+		case clientID := <-opened:
+			if clientID != 1 {
+				t.Fatalf("opened client %d, want 1", clientID)
+			}
+			select {
+			case <-playerOpen:
+			case <-timeout:
+				t.Fatal("player's data channel didn't open")
+			}
+			if uses := server.Invites()[0].Uses; uses != 1 {
+				t.Fatalf("invite used %d times, want 1", uses)
+			}
+			return
+		case <-timeout:
+			t.Fatal("player didn't connect")
+		}
+	}
+}
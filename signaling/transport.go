@@ -0,0 +1,238 @@
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport carries signaling messages between the host and the signaling
+// server. Receive blocks until a message arrives and only fails when the
+// connection is lost; Connect can then be called again.
+type Transport interface {
+	Connect() error
+	Send(msg Message) error
+	Receive() (Message, error)
+	Close() error
+}
+
+// decodeForHost decodes a packet sent to the host by the signaling server
+func decodeForHost(data []byte) (Message, error) {
+	var env WebsocketResponse
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	switch env.Type {
+	case "createInvite":
+		return decodeAs[CreateInviteResponse](data)
+	case "joinInvite":
+		return decodeAs[JoinInvite](data)
+	case "iceCandidate":
+		return decodeAs[IceCandidateResponse](data)
+	}
+	return nil, fmt.Errorf("unknown packet type %q", env.Type)
+}
+
+// decodeFromHost decodes a packet sent by a host to the signaling server
+func decodeFromHost(data []byte) (Message, error) {
+	var env WebsocketResponse
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	switch env.Type {
+	case "createInvite":
+		return decodeAs[CreateInviteRequest](data)
+	case "acceptJoin":
+		return decodeAs[AcceptJoinPacket](data)
+	case "iceCandidate":
+		return decodeAs[IceCandidatePacket](data)
+	}
+	return nil, fmt.Errorf("unknown packet type %q", env.Type)
+}
+
+func decodeAs[T Message](data []byte) (Message, error) {
+	var msg T
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+//
+// WEBSOCKET
+//
+
+// WebsocketTransport talks JSON over a websocket, to vps.kodub.com or to the
+// host endpoint of another server's LocalServer
+type WebsocketTransport struct {
+	URL  string
+	lock sync.Mutex // guards conn and writes
+	conn *websocket.Conn
+}
+
+func NewWebsocketTransport(url string) *WebsocketTransport {
+	return &WebsocketTransport{URL: url}
+}
+
+func (t *WebsocketTransport) Connect() error {
+	conn, _, err := websocket.DefaultDialer.Dial(t.URL, nil)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.conn = conn
+	t.lock.Unlock()
+	return nil
+}
+
+func (t *WebsocketTransport) Send(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	return t.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (t *WebsocketTransport) Receive() (Message, error) {
+	t.lock.Lock()
+	conn := t.conn
+	t.lock.Unlock()
+	if conn == nil {
+		return nil, fmt.Errorf("not connected")
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		msg, err := decodeForHost(data)
+		if err != nil {
+			logger.Warn("Invalid signaling packet", "err", err)
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// Close says goodbye to the signaling server and closes the websocket
+func (t *WebsocketTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+	if err != nil {
+		logger.Warn("Failed to send websocket close", "err", err)
+	}
+	return t.conn.Close()
+}
+
+//
+// LOOPBACK
+//
+
+// Loopback is an in-process signaling server for a single host, to drive a
+// server without any network, e.g. in integration tests. Players join with
+// Join and Candidate and read what the host answers from Outbox.
+type Loopback struct {
+	toHost  chan Message
+	Outbox  chan Message
+	lock    sync.Mutex
+	closed  chan struct{}
+	invites int
+}
+
+func NewLoopback() *Loopback {
+	return &Loopback{
+		toHost: make(chan Message, 64),
+		Outbox: make(chan Message, 64),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *Loopback) Connect() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	select {
+	case <-l.closed:
+		return net.ErrClosed
+	default:
+		return nil
+	}
+}
+
+func (l *Loopback) Send(msg Message) error {
+	if _, ok := msg.(CreateInviteRequest); ok {
+		l.lock.Lock()
+		l.invites++
+		code := "LOOP" + strconv.Itoa(l.invites)
+		l.lock.Unlock()
+		return l.deliver(CreateInviteResponse{Type: "createInvite", InviteCode: code})
+	}
+	select {
+	case l.Outbox <- msg:
+		return nil
+	case <-l.closed:
+		return net.ErrClosed
+	}
+}
+
+func (l *Loopback) Receive() (Message, error) {
+	select {
+	case msg := <-l.toHost:
+		return msg, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Loopback) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+// Join sends a player's join request to the host
+func (l *Loopback) Join(join JoinInvite) error {
+	join.Type = "joinInvite"
+	return l.deliver(join)
+}
+
+// Candidate sends a player's ICE candidate to the host
+func (l *Loopback) Candidate(candidate IceCandidateResponse) error {
+	candidate.Type = "iceCandidate"
+	return l.deliver(candidate)
+}
+
+func (l *Loopback) deliver(msg Message) error {
+	select {
+	case l.toHost <- msg:
+		return nil
+	case <-l.closed:
+		return net.ErrClosed
+	}
+}
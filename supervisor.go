@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"polyserver/logging"
+	"sync"
+	"time"
+)
+
+var supervisorLogger = logging.For("supervisor")
+
+const crashHistorySize = 20
+
+var errAlreadyRunning = errors.New("already running")
+
+type SupervisorState string
+
+const (
+	StateRunning    SupervisorState = "running"
+	StateRestarting SupervisorState = "restarting"
+	StateStopped    SupervisorState = "stopped"
+	// Too many crashes inside the restart window, only a manual start helps
+	StateFailed SupervisorState = "failed"
+)
+
+// RestartPolicy decides when a crashed server gets started again
+type RestartPolicy struct {
+	Backoff    time.Duration // delay before the first restart, doubled on each crash
+	MaxBackoff time.Duration
+	// A server that ran this long resets the backoff
+	StableAfter time.Duration
+	// More than MaxRestarts crashes inside Window stops restarting, 0 never gives up
+	MaxRestarts int
+	Window      time.Duration
+}
+
+type Crash struct {
+	Time     time.Time `json:"time"`
+	PID      int       `json:"pid"`
+	ExitCode int       `json:"exitCode"` // -1 when killed by a signal
+	Error    string    `json:"error"`
+	Uptime   float64   `json:"uptimeSeconds"`
+}
+
+type SupervisorStatus struct {
+	State         SupervisorState `json:"state"`
+	Running       bool            `json:"running"`
+	PID           int             `json:"pid"`
+	StartedAt     *time.Time      `json:"startedAt"`
+	Restarts      int             `json:"restarts"`
+	NextRestartAt *time.Time      `json:"nextRestartAt"`
+	Backoff       float64         `json:"backoffSeconds"`
+	Crashes       []Crash         `json:"crashes"`
+}
+
+// serverProcess is a game server child process
+type serverProcess struct {
+	cmd       *exec.Cmd
+	startedAt time.Time
+	done      chan struct{}
+	// Set when the supervisor stopped it on purpose
+	stopping bool
+}
+
+func (p *serverProcess) running() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// supervisor runs the game server process and restarts it when it crashes.
+// The server is always started with the same arguments.
+type supervisor struct {
+	lock        sync.Mutex
+	args        []string
+	controlPort int
+	stopTimeout time.Duration
+	policy      RestartPolicy
+
+	process       *serverProcess
+	state         SupervisorState
+	restarts      int
+	backoff       time.Duration
+	restartTimer  *time.Timer
+	nextRestartAt *time.Time
+	crashes       []Crash
+}
+
+func newSupervisor(args []string, controlPort int, stopTimeout time.Duration, policy RestartPolicy) *supervisor {
+	return &supervisor{
+		args:        args,
+		controlPort: controlPort,
+		stopTimeout: stopTimeout,
+		policy:      policy,
+		state:       StateStopped,
+		backoff:     policy.Backoff,
+	}
+}
+
+// start starts the server unless it's already running. A manual start also
+// gets a failed supervisor going again.
+func (s *supervisor) start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.process != nil && s.process.running() {
+		return errAlreadyRunning
+	}
+	s.cancelRestart()
+	s.backoff = s.policy.Backoff
+	return s.spawn()
+}
+
+// spawn starts the server process, s.lock must be held
+func (s *supervisor) spawn() error {
+
+	cmd := exec.Command(os.Args[0], s.args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		s.state = StateStopped
+		return err
+	}
+	supervisorLogger.Info("Server started", "pid", cmd.Process.Pid)
+
+	// done is closed by exited, so the process counts as running until its
+	// exit is recorded
+	p := &serverProcess{cmd: cmd, startedAt: time.Now(), done: make(chan struct{})}
+	s.process = p
+	s.state = StateRunning
+
+	go func() {
+		s.exited(p, cmd.Wait())
+	}()
+	return nil
+}
+
+// exited records how the server exited and schedules a restart if it crashed
+func (s *supervisor) exited(p *serverProcess, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// Runs before the unlock, after the bookkeeping
+	defer close(p.done)
+
+	// Only the current process decides the state
+	if s.process != p {
+		return
+	}
+
+	// A clean exit means the server was drained, e.g. through its own API
+	if p.stopping || err == nil {
+		supervisorLogger.Info("Server stopped", "pid", p.cmd.Process.Pid)
+		s.state = StateStopped
+		return
+	}
+
+	now := time.Now()
+	crash := Crash{
+		Time:     now,
+		PID:      p.cmd.Process.Pid,
+		ExitCode: p.cmd.ProcessState.ExitCode(),
+		Uptime:   now.Sub(p.startedAt).Seconds(),
+	}
+	if err != nil {
+		crash.Error = err.Error()
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		// Wait itself failed, there's no exit code
+		crash.ExitCode = -1
+	}
+	s.crashes = append(s.crashes, crash)
+	if len(s.crashes) > crashHistorySize {
+		s.crashes = s.crashes[len(s.crashes)-crashHistorySize:]
+	}
+	supervisorLogger.Warn("Server exited unexpectedly", "pid", crash.PID, "exitCode", crash.ExitCode, "uptime", now.Sub(p.startedAt).Round(time.Second), "err", crash.Error)
+
+	if s.policy.MaxRestarts > 0 && s.crashesSince(now.Add(-s.policy.Window)) > s.policy.MaxRestarts {
+		supervisorLogger.Error("Server keeps crashing, giving up", "crashes", s.policy.MaxRestarts+1, "window", s.policy.Window)
+		s.state = StateFailed
+		return
+	}
+
+	if now.Sub(p.startedAt) >= s.policy.StableAfter {
+		s.backoff = s.policy.Backoff
+	}
+	delay := s.backoff
+	s.backoff = min(s.backoff*2, s.policy.MaxBackoff)
+
+	next := now.Add(delay)
+	s.nextRestartAt = &next
+	s.state = StateRestarting
+	supervisorLogger.Info("Restarting server", "in", delay)
+
+	s.restartTimer = time.AfterFunc(delay, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.state != StateRestarting {
+			return
+		}
+		s.nextRestartAt = nil
+		s.restarts++
+		if err := s.spawn(); err != nil {
+			supervisorLogger.Error("Failed to restart server", "err", err)
+		}
+	})
+}
+
+func (s *supervisor) crashesSince(t time.Time) int {
+	count := 0
+	for _, c := range s.crashes {
+		if c.Time.After(t) {
+			count++
+		}
+	}
+	return count
+}
+
+// cancelRestart drops a pending restart, s.lock must be held
+func (s *supervisor) cancelRestart() {
+	if s.restartTimer != nil {
+		s.restartTimer.Stop()
+		s.restartTimer = nil
+	}
+	s.nextRestartAt = nil
+}
+
+// stop asks the server to drain and waits for it to exit, killing it if it
+// takes longer than stopTimeout. It's not restarted afterwards.
+func (s *supervisor) stop() {
+	s.lock.Lock()
+	s.cancelRestart()
+	p := s.process
+	if p == nil || !p.running() {
+		s.state = StateStopped
+		s.lock.Unlock()
+		return
+	}
+	p.stopping = true
+	s.lock.Unlock()
+
+	timeout := s.stopTimeout
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/drain", s.controlPort), "application/json", nil)
+	if err != nil {
+		supervisorLogger.Warn("Drain request failed, killing server", "err", err)
+		timeout = 0
+	} else {
+		resp.Body.Close()
+	}
+
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		supervisorLogger.Warn("Server did not exit in time, killing it")
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+func (s *supervisor) status() SupervisorStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := SupervisorStatus{
+		State:         s.state,
+		Restarts:      s.restarts,
+		NextRestartAt: s.nextRestartAt,
+		Backoff:       s.backoff.Seconds(),
+		Crashes:       append([]Crash{}, s.crashes...),
+	}
+	if s.process != nil {
+		status.Running = s.process.running()
+		status.PID = s.process.cmd.Process.Pid
+		startedAt := s.process.startedAt
+		status.StartedAt = &startedAt
+	}
+	return status
+}
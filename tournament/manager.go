@@ -0,0 +1,218 @@
+package tournament
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"polyserver/game"
+	gametrack "polyserver/game/track"
+	"polyserver/logging"
+	"sync"
+	"time"
+)
+
+var logger = logging.For("tournament")
+
+// Manager drives a tournament on a game server and keeps it saved on disk
+type Manager struct {
+	Path       string
+	Server     *game.GameServer
+	Tracks     map[string]*gametrack.Track
+	Tournament *Tournament
+	lock       sync.Mutex
+}
+
+func NewManager(path string, server *game.GameServer, tracks map[string]*gametrack.Track) *Manager {
+	m := &Manager{
+		Path:   path,
+		Server: server,
+		Tracks: tracks,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Could not read tournament file", "path", path, "err", err)
+		}
+		return m
+	}
+
+	var t Tournament
+	if err := json.Unmarshal(data, &t); err != nil {
+		logger.Warn("Invalid tournament file", "path", path, "err", err)
+		return m
+	}
+
+	// A heat can't still be running after a restart
+	if heat := t.RunningHeat(); heat != nil {
+		heat.Status = HeatPending
+		heat.StartedAt = nil
+	}
+
+	m.Tournament = &t
+	logger.Info("Loaded tournament", "name", t.Name)
+	return m
+}
+
+// Get returns a copy of the current tournament so callers can encode it safely
+func (m *Manager) Get() *Tournament {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.Tournament == nil {
+		return nil
+	}
+	data, _ := json.Marshal(m.Tournament)
+	var t Tournament
+	json.Unmarshal(data, &t)
+	return &t
+}
+
+func (m *Manager) Create(name string, heatSize int, rounds []RoundConfig, players []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.Tournament != nil && m.Tournament.RunningHeat() != nil {
+		return fmt.Errorf("a heat is still running")
+	}
+	for _, r := range rounds {
+		for _, name := range r.Tracks {
+			if _, ok := m.Tracks[name]; !ok {
+				return fmt.Errorf("track %s not found", name)
+			}
+		}
+	}
+
+	t, err := New(name, heatSize, rounds, players)
+	if err != nil {
+		return err
+	}
+	m.Tournament = t
+	logger.Info("Created tournament", "name", name, "players", len(players))
+	return m.save()
+}
+
+func (m *Manager) StartHeat(index int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.Tournament == nil {
+		return fmt.Errorf("no tournament")
+	}
+	round := m.Tournament.Round()
+	if round == nil {
+		return fmt.Errorf("tournament is finished")
+	}
+	if m.Tournament.RunningHeat() != nil {
+		return fmt.Errorf("another heat is still running")
+	}
+	if index < 0 || index >= len(round.Heats) {
+		return fmt.Errorf("heat %d does not exist", index)
+	}
+	heat := round.Heats[index]
+	if heat.Status != HeatPending {
+		return fmt.Errorf("heat %d was already driven", index)
+	}
+
+	// Tracks may have been removed since the tournament was created
+	track, ok := m.Tracks[heat.Track]
+	if !ok {
+		return fmt.Errorf("track %s not found", heat.Track)
+	}
+
+	if !m.Server.Session().SwitchingSession {
+		if err := m.Server.EndSession(); err != nil {
+			return err
+		}
+	}
+	current := m.Server.Session()
+	m.Server.UpdateGameSession(game.GameSession{
+		GameMode:          game.Competitive,
+		SwitchingSession:  true,
+		CurrentTrack:      track,
+		MaxPlayers:        current.MaxPlayers,
+		CarUpdateInterval: current.CarUpdateInterval,
+		PingInterval:      current.PingInterval,
+	})
+	if err := m.Server.StartSession(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	heat.Status = HeatRunning
+	heat.SessionID = m.Server.Session().SessionID
+	heat.StartedAt = &now
+	logger.Info("Started heat", "round", round.Name, "heat", index+1, "track", heat.Track)
+
+	return m.save()
+}
+
+// FinishHeat ends the running heat, records its results and advances the
+// bracket once the whole round is done
+func (m *Manager) FinishHeat() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.Tournament == nil {
+		return fmt.Errorf("no tournament")
+	}
+	heat := m.Tournament.RunningHeat()
+	if heat == nil {
+		return fmt.Errorf("no heat is running")
+	}
+	if m.Server.Session().SessionID != heat.SessionID {
+		return fmt.Errorf("session changed while the heat was running")
+	}
+
+	times, err := m.Server.FinishTimes(heat.SessionID)
+	if err != nil {
+		return err
+	}
+	heat.RecordResults(times)
+	// The session may have been ended from the control API already
+	if !m.Server.Session().SwitchingSession {
+		if err := m.Server.EndSession(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	heat.Status = HeatFinished
+	heat.FinishedAt = &now
+	logger.Info("Finished heat", "heat", heat.Index+1)
+
+	if m.Tournament.Advance() {
+		if m.Tournament.Finished() {
+			logger.Info("Tournament finished", "winner", m.Tournament.Winner)
+		} else {
+			logger.Info("Advanced to next round", "round", m.Tournament.Round().Name)
+		}
+	}
+
+	return m.save()
+}
+
+func (m *Manager) Reset() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.Tournament = nil
+	if err := os.Remove(m.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) save() error {
+	data, err := json.MarshalIndent(m.Tournament, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode tournament: %w", err)
+	}
+
+	// Write to a temp file first so a crash never leaves a half-written bracket
+	tmp := m.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save tournament: %w", err)
+	}
+	return os.Rename(tmp, m.Path)
+}
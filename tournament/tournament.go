@@ -0,0 +1,224 @@
+package tournament
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+type HeatStatus string
+
+const (
+	HeatPending  HeatStatus = "pending"
+	HeatRunning  HeatStatus = "running"
+	HeatFinished HeatStatus = "finished"
+)
+
+type Tournament struct {
+	Name      string    `json:"name"`
+	HeatSize  int       `json:"heatSize"`
+	Rounds    []*Round  `json:"rounds"`
+	Current   int       `json:"currentRound"`
+	Winner    string    `json:"winner,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type RoundConfig struct {
+	Name    string   `json:"name"`
+	Tracks  []string `json:"tracks"`
+	Advance int      `json:"advance"` // players per heat moving on
+}
+
+type Round struct {
+	RoundConfig
+	Heats []*Heat `json:"heats"`
+}
+
+type Heat struct {
+	Index      int        `json:"index"`
+	Track      string     `json:"track"`
+	Players    []string   `json:"players"` // nicknames in seed order
+	Status     HeatStatus `json:"status"`
+	SessionID  uint32     `json:"sessionId"`
+	Results    []Result   `json:"results"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+type Result struct {
+	Position int     `json:"position"`
+	Nickname string  `json:"nickname"`
+	Frames   *uint32 `json:"frames"` // nil means did not finish
+}
+
+func New(name string, heatSize int, rounds []RoundConfig, players []string) (*Tournament, error) {
+	if heatSize < 2 {
+		return nil, fmt.Errorf("heat size must be at least 2")
+	}
+	if len(rounds) == 0 {
+		return nil, fmt.Errorf("at least one round is required")
+	}
+	if len(players) < 2 {
+		return nil, fmt.Errorf("at least two players are required")
+	}
+	for i, r := range rounds {
+		if len(r.Tracks) == 0 {
+			return nil, fmt.Errorf("round %d has no tracks", i+1)
+		}
+		if r.Advance < 1 && i < len(rounds)-1 {
+			return nil, fmt.Errorf("round %d must advance at least one player per heat", i+1)
+		}
+	}
+	// Results are matched to players by nickname
+	seen := make(map[string]bool, len(players))
+	for _, player := range players {
+		if seen[player] {
+			return nil, fmt.Errorf("player %s is listed more than once", player)
+		}
+		seen[player] = true
+	}
+
+	t := &Tournament{
+		Name:      name,
+		HeatSize:  heatSize,
+		CreatedAt: time.Now(),
+	}
+	for _, r := range rounds {
+		t.Rounds = append(t.Rounds, &Round{RoundConfig: r})
+	}
+	t.seedRound(0, players)
+	return t, nil
+}
+
+func (t *Tournament) Round() *Round {
+	if t.Current >= len(t.Rounds) {
+		return nil
+	}
+	return t.Rounds[t.Current]
+}
+
+// RunningHeat returns the heat currently being driven, if any
+func (t *Tournament) RunningHeat() *Heat {
+	round := t.Round()
+	if round == nil {
+		return nil
+	}
+	for _, heat := range round.Heats {
+		if heat.Status == HeatRunning {
+			return heat
+		}
+	}
+	return nil
+}
+
+// seedRound splits the seeded players into heats snake-style so the top
+// seeds are spread evenly across heats
+func (t *Tournament) seedRound(index int, players []string) {
+	round := t.Rounds[index]
+
+	numHeats := (len(players) + t.HeatSize - 1) / t.HeatSize
+	round.Heats = make([]*Heat, numHeats)
+	for i := range round.Heats {
+		round.Heats[i] = &Heat{
+			Index:   i,
+			Track:   round.Tracks[i%len(round.Tracks)],
+			Players: []string{},
+			Status:  HeatPending,
+			Results: []Result{},
+		}
+	}
+
+	for i, player := range players {
+		pass := i / numHeats
+		heat := i % numHeats
+		if pass%2 == 1 {
+			heat = numHeats - 1 - heat
+		}
+		round.Heats[heat].Players = append(round.Heats[heat].Players, player)
+	}
+}
+
+// RecordResults ranks the heat's players by their recorded frames, with
+// players who did not finish ranked last in seed order
+func (heat *Heat) RecordResults(times map[string]uint32) {
+	heat.Results = make([]Result, 0, len(heat.Players))
+	for _, player := range heat.Players {
+		result := Result{Nickname: player}
+		if frames, ok := times[player]; ok {
+			result.Frames = &frames
+		}
+		heat.Results = append(heat.Results, result)
+	}
+
+	sort.SliceStable(heat.Results, func(i, j int) bool {
+		a, b := heat.Results[i].Frames, heat.Results[j].Frames
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return *a < *b
+	})
+
+	for i := range heat.Results {
+		heat.Results[i].Position = i + 1
+	}
+}
+
+// Advance moves the qualifying players of the current round into the next
+// one once every heat has finished. It reports whether the round changed.
+func (t *Tournament) Advance() bool {
+	round := t.Round()
+	if round == nil {
+		return false
+	}
+	for _, heat := range round.Heats {
+		if heat.Status != HeatFinished {
+			return false
+		}
+	}
+
+	// Last round, or a single heat left: the tournament is decided
+	if t.Current == len(t.Rounds)-1 {
+		t.Current++
+		if len(round.Heats) == 1 && len(round.Heats[0].Results) > 0 && round.Heats[0].Results[0].Frames != nil {
+			t.Winner = round.Heats[0].Results[0].Nickname
+		}
+		return true
+	}
+
+	// Qualifiers are seeded by finishing position first, then by time.
+	// Players who did not finish never qualify.
+	var qualifiers []Result
+	for _, heat := range round.Heats {
+		for _, result := range heat.Results {
+			if result.Position <= round.Advance && result.Frames != nil {
+				qualifiers = append(qualifiers, result)
+			}
+		}
+	}
+	sort.SliceStable(qualifiers, func(i, j int) bool {
+		a, b := qualifiers[i], qualifiers[j]
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return *a.Frames < *b.Frames
+	})
+
+	players := make([]string, 0, len(qualifiers))
+	for _, q := range qualifiers {
+		players = append(players, q.Nickname)
+	}
+
+	// Nobody finished a heat, the tournament ends without a winner
+	if len(players) == 0 {
+		t.Current = len(t.Rounds)
+		return true
+	}
+
+	t.Current++
+	t.seedRound(t.Current, players)
+	return true
+}
+
+func (t *Tournament) Finished() bool {
+	return t.Current >= len(t.Rounds)
+}
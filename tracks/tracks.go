@@ -1,25 +1,29 @@
 package tracks
 
 import (
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
 	gametrack "polyserver/game/track"
+	"polyserver/logging"
 )
 
+var logger = logging.For("tracks")
+
 func LoadTrack(path string) *gametrack.Track {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatalf("Failed to read track file %s: %v", path, err)
+		logger.Error("Failed to read track file", "path", path, "err", err)
+		os.Exit(1)
 	}
 
 	s := strings.TrimSpace(string(data))
 
 	t, err := gametrack.DecodePolyTrack2(s)
 	if err != nil {
-		log.Fatalf("Failed to decode track %s: %v", path, err)
+		logger.Error("Failed to decode track", "path", path, "err", err)
+		os.Exit(1)
 	}
 
 	return t
@@ -31,7 +35,7 @@ func LoadAllTracks(dir string) (map[string]*gametrack.Track, []string) {
 
 	entries, err := os.ReadDir(dir)
 	if err != nil {
-		log.Printf("Could not read tracks directory %q: %v", dir, err)
+		logger.Warn("Could not read tracks directory", "dir", dir, "err", err)
 		return out, names
 	}
 
@@ -49,7 +53,7 @@ func LoadAllTracks(dir string) (map[string]*gametrack.Track, []string) {
 		out[base] = t
 		names = append(names, base)
 
-		log.Printf("Loaded track %s", base)
+		logger.Info("Loaded track", "name", base)
 	}
 
 	return out, names
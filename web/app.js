@@ -4,11 +4,21 @@ async function updateStatus() {
   const r = await fetch("/api/server/status");
   const data = await r.json();
 
-  document.getElementById("status").textContent = data.running
-    ? "Running"
-    : "Stopped";
+  const states = {
+    running: "Running",
+    restarting: "Restarting",
+    stopped: "Stopped",
+    failed: "Failed (crashing)",
+  };
+  document.getElementById("status").textContent = states[data.state] || data.state;
 
   document.getElementById("pid").textContent = data.running ? data.pid : "-";
+  document.getElementById("restarts").textContent = data.restarts;
+
+  const last = data.crashes[data.crashes.length - 1];
+  document.getElementById("lastCrash").textContent = last
+    ? `(last crash ${new Date(last.time).toLocaleTimeString()}, exit code ${last.exitCode})`
+    : "";
 }
 
 async function startServer() {
@@ -137,7 +147,7 @@ async function loadPlayers() {
       tr.innerHTML = `
         <td>${p.name}</td>
         <td>${p.time}</td>
-        <td>${p.ping} ms</td>
+        <td id="ping-${p.id}">${p.ping} ms</td>
         <td><button class="uk-button uk-button-danger" type="button" onclick="kickPlayer(${p.id})">Kick</button></td>
       `;
 
@@ -156,16 +166,260 @@ async function kickPlayer(id) {
   });
 }
 
+// ---------- TOURNAMENT ----------
+
+function formatFrames(frames) {
+  return frames == null ? "DNF" : (frames / 1000).toFixed(3) + "s";
+}
+
+async function loadTournament() {
+  const div = document.getElementById("tournament");
+  try {
+    const r = await fetch("/api/tournament");
+    if (!r.ok) {
+      div.innerHTML = "<p>No tournament</p>";
+      document.getElementById("finishHeatBtn").disabled = true;
+      return;
+    }
+    const t = await r.json();
+
+    let html = `<p>${t.name}${t.winner ? ` - winner: <strong>${t.winner}</strong>` : ""}</p>`;
+    let running = false;
+    t.rounds.forEach((round, roundIndex) => {
+      html += `<h3 class="uk-light">${round.name}${roundIndex === t.currentRound ? " (current)" : ""}</h3>`;
+      (round.heats || []).forEach((heat) => {
+        running = running || heat.status === "running";
+        const rows = heat.status === "finished"
+          ? heat.results.map((res) => `<tr><td>${res.position}</td><td>${res.nickname}</td><td>${formatFrames(res.frames)}</td></tr>`)
+          : heat.players.map((name, i) => `<tr><td>${i + 1}</td><td>${name}</td><td>-</td></tr>`);
+        const startBtn = roundIndex === t.currentRound && heat.status === "pending"
+          ? `<button class="uk-button uk-button-primary" type="button" onclick="startHeat(${heat.index})">Start Heat</button>`
+          : "";
+        html += `
+          <p>Heat ${heat.index + 1} on <strong>${heat.track}</strong> - ${heat.status} ${startBtn}</p>
+          <table class="uk-table uk-table-divider uk-table-small uk-width-1-2"><tbody>${rows.join("")}</tbody></table>
+        `;
+      });
+    });
+    div.innerHTML = html;
+    document.getElementById("finishHeatBtn").disabled = !running;
+  } catch {
+    // server not running
+  }
+}
+
+async function createTournament() {
+  const players = document.getElementById("tournamentPlayers").value
+    .split("\n").map((s) => s.trim()).filter((s) => s.length > 0);
+  const rounds = document.getElementById("tournamentRounds").value
+    .split("\n").filter((s) => s.trim().length > 0).map((line) => {
+      const [name, tracks, advance] = line.split("|").map((s) => s.trim());
+      return {
+        name,
+        tracks: (tracks || "").split(",").map((s) => s.trim()).filter((s) => s.length > 0),
+        advance: parseInt(advance) || 0,
+      };
+    });
+
+  const r = await fetch("/api/tournament", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({
+      name: document.getElementById("tournamentName").value,
+      heatSize: parseInt(document.getElementById("tournamentHeatSize").value),
+      rounds,
+      players,
+    }),
+  });
+  if (!r.ok) alert(await r.text());
+  await loadTournament();
+}
+
+async function startHeat(heat) {
+  const r = await fetch("/api/tournament/heat/start", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ heat }),
+  });
+  if (!r.ok) alert(await r.text());
+  await loadTournament();
+  await loadServerData();
+}
+
+async function finishHeat() {
+  const r = await fetch("/api/tournament/heat/finish", { method: "POST" });
+  if (!r.ok) alert(await r.text());
+  await loadTournament();
+  await loadServerData();
+}
+
+async function resetTournament() {
+  if (!confirm("Delete the current tournament?")) return;
+  await fetch("/api/tournament/reset", { method: "POST" });
+  await loadTournament();
+}
+
+// ---------- LIVE MAP ----------
+
+// World units per track block
+const BLOCK_SIZE = 5;
+// Direction the car faces before its rotation is applied
+const CAR_FORWARD = { x: 0, y: 0, z: -1 };
+
+let mapLayout = null;
+let mapSessionId = null;
+let mapSource = null;
+let mapCars = [];
+
+async function loadLayout() {
+  const r = await fetch("/api/track/layout");
+  mapLayout = r.ok ? await r.json() : null;
+}
+
+function toggleMap() {
+  const btn = document.getElementById("mapBtn");
+  if (mapSource) {
+    mapSource.close();
+    mapSource = null;
+    btn.textContent = "Watch";
+    return;
+  }
+
+  mapSource = new EventSource("/api/spectate?hz=5");
+  mapSource.addEventListener("positions", async (e) => {
+    const data = JSON.parse(e.data);
+    if (data.sessionId !== mapSessionId) {
+      mapSessionId = data.sessionId;
+      await loadLayout();
+    }
+    mapCars = data.cars;
+    drawMap();
+  });
+  btn.textContent = "Stop Watching";
+}
+
+// Rotates v by quaternion q
+function rotate(q, v) {
+  const ix = q.w * v.x + q.y * v.z - q.z * v.y;
+  const iy = q.w * v.y + q.z * v.x - q.x * v.z;
+  const iz = q.w * v.z + q.x * v.y - q.y * v.x;
+  const iw = -q.x * v.x - q.y * v.y - q.z * v.z;
+  return {
+    x: ix * q.w + iw * -q.x + iy * -q.z - iz * -q.y,
+    y: iy * q.w + iw * -q.y + iz * -q.x - ix * -q.z,
+    z: iz * q.w + iw * -q.z + ix * -q.y - iy * -q.x,
+  };
+}
+
+function drawMap() {
+  const canvas = document.getElementById("mapCanvas");
+  const ctx = canvas.getContext("2d");
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+  if (!mapLayout) return;
+
+  // Fit the track and every car onto the canvas, looking down on X/Z
+  let minX = Infinity, maxX = -Infinity, minZ = Infinity, maxZ = -Infinity;
+  const extend = (x, z) => {
+    minX = Math.min(minX, x); maxX = Math.max(maxX, x);
+    minZ = Math.min(minZ, z); maxZ = Math.max(maxZ, z);
+  };
+  mapLayout.blocks.forEach((b) => extend(b.x * BLOCK_SIZE, b.z * BLOCK_SIZE));
+  mapCars.forEach((c) => extend(c.position.x, c.position.z));
+  if (minX === Infinity) return;
+
+  const margin = BLOCK_SIZE * 2;
+  minX -= margin; maxX += margin; minZ -= margin; maxZ += margin;
+  const scale = Math.min(canvas.width / (maxX - minX), canvas.height / (maxZ - minZ));
+  const toCanvas = (x, z) => [(x - minX) * scale, (z - minZ) * scale];
+
+  const blockSize = Math.max(1, BLOCK_SIZE * scale);
+  mapLayout.blocks.forEach((b) => {
+    ctx.fillStyle = b.kind === "checkpoint" ? "#eab308" : b.kind === "start" ? "#22c55e" : "#4b5563";
+    const [x, y] = toCanvas(b.x * BLOCK_SIZE, b.z * BLOCK_SIZE);
+    ctx.fillRect(x - blockSize / 2, y - blockSize / 2, blockSize, blockSize);
+  });
+
+  ctx.font = "12px system-ui, sans-serif";
+  mapCars.forEach((c) => {
+    const [x, y] = toCanvas(c.position.x, c.position.z);
+    const color = "#" + c.color.toString(16).padStart(6, "0");
+    const forward = rotate(c.quaternion, CAR_FORWARD);
+
+    ctx.strokeStyle = color;
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    ctx.moveTo(x, y);
+    ctx.lineTo(x + forward.x * 12, y + forward.z * 12);
+    ctx.stroke();
+
+    ctx.fillStyle = color;
+    ctx.beginPath();
+    ctx.arc(x, y, 5, 0, 2 * Math.PI);
+    ctx.fill();
+
+    ctx.fillStyle = "#e5e7eb";
+    ctx.fillText(c.nickname, x + 8, y - 8);
+  });
+}
+
+// ---------- EVENTS ----------
+
+// Coalesces bursts of events into a single reload
+function debounce(fn, ms) {
+  let timer = null;
+  return () => {
+    clearTimeout(timer);
+    timer = setTimeout(fn, ms);
+  };
+}
+
+function subscribeEvents() {
+  const reloadPlayers = debounce(loadPlayers, 100);
+  const reloadServerData = debounce(loadServerData, 100);
+  const reloadTournament = debounce(loadTournament, 100);
+
+  const source = new EventSource("/api/events");
+
+  ["player.join", "player.leave", "player.record", "player.reset"].forEach((type) => {
+    source.addEventListener(type, reloadPlayers);
+  });
+  source.addEventListener("player.record", reloadTournament);
+  source.addEventListener("session", () => {
+    reloadServerData();
+    reloadTournament();
+  });
+  source.addEventListener("invite", (e) => {
+    inviteBox.textContent = JSON.parse(e.data).data.invite || "-";
+  });
+  source.addEventListener("pings", (e) => {
+    JSON.parse(e.data).data.forEach((p) => {
+      const cell = document.getElementById(`ping-${p.id}`);
+      if (cell) cell.textContent = `${p.ping} ms`;
+    });
+  });
+
+  source.onopen = () => {
+    loadPlayers();
+    loadServerData();
+    loadTournament();
+  };
+  // EventSource reconnects by itself, e.g. after a server restart
+}
+
 // ---------- INIT ----------
 
 function main() {
   updateStatus();
   loadServerData();
   loadPlayers();
+  loadTournament();
+  subscribeEvents();
 
+  // Events push changes as they happen, polling is only a fallback
   setInterval(updateStatus, 2000);
-  setInterval(loadPlayers, 1000);
-  setInterval(loadServerData, 3000);
+  setInterval(loadPlayers, 15000);
+  setInterval(loadServerData, 15000);
+  setInterval(loadTournament, 15000);
 }
 
 main();
@@ -0,0 +1,97 @@
+const params = new URLSearchParams(location.search);
+const shown = (params.get("show") || "track,timer,standings,records").split(",");
+const rows = parseInt(params.get("rows") || "10");
+
+shown.forEach((id) => {
+  const panel = document.getElementById(id);
+  if (panel) panel.classList.add("shown");
+});
+
+// Frames are milliseconds
+function formatTime(frames) {
+  const seconds = frames / 1000;
+  const minutes = Math.floor(seconds / 60);
+  const rest = (seconds % 60).toFixed(3).padStart(6, "0");
+  return minutes > 0 ? `${minutes}:${rest}` : `${rest}s`;
+}
+
+function formatGap(standing) {
+  if (standing.position === 1) return standing.finished ? formatTime(standing.finishFrames) : "";
+  if (standing.checkpointsBehind > 0 && !standing.finished) return `+${standing.checkpointsBehind} CP`;
+  if (standing.gapFrames !== null) return `+${(standing.gapFrames / 1000).toFixed(3)}`;
+  return "";
+}
+
+function cell(text, cls) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  if (cls) td.className = cls;
+  return td;
+}
+
+function fillRows(tbody, items, render) {
+  tbody.replaceChildren(
+    ...items.slice(0, rows).map((item) => {
+      const tr = document.createElement("tr");
+      tr.append(...render(item));
+      return tr;
+    })
+  );
+}
+
+let startedAt = null;
+
+async function loadNow() {
+  const now = await (await fetch("/feed/now")).json();
+  document.getElementById("trackName").textContent = now.trackName || "-";
+  document.getElementById("trackAuthor").textContent = now.trackAuthor ? `by ${now.trackAuthor}` : "";
+  startedAt = now.startedAt ? Date.now() - now.elapsed * 1000 : null;
+}
+
+function renderStandings(standings) {
+  fillRows(document.getElementById("standingsRows"), standings, (s) => [
+    cell(s.position, "pos"),
+    cell(s.nickname),
+    cell(formatGap(s), "time"),
+  ]);
+}
+
+async function loadStandings() {
+  renderStandings((await (await fetch("/feed/standings")).json()).standings);
+}
+
+async function loadRecords() {
+  const data = await (await fetch("/feed/records?limit=" + rows)).json();
+  fillRows(document.getElementById("recordsRows"), data.records, (r) => [
+    cell(r.nickname),
+    cell(formatTime(r.frames), "time"),
+  ]);
+}
+
+function tickTimer() {
+  const el = document.getElementById("timerValue");
+  if (startedAt === null) {
+    el.textContent = "--:--";
+    return;
+  }
+  const seconds = Math.floor((Date.now() - startedAt) / 1000);
+  el.textContent = `${Math.floor(seconds / 60)}:${String(seconds % 60).padStart(2, "0")}`;
+}
+
+function connect() {
+  const source = new EventSource("/feed/events");
+  source.addEventListener("session", () => {
+    loadNow();
+    loadStandings();
+  });
+  source.addEventListener("standings", (e) => renderStandings(JSON.parse(e.data).data));
+  source.addEventListener("player.record", loadRecords);
+  source.onopen = () => {
+    loadNow();
+    loadStandings();
+    loadRecords();
+  };
+}
+
+connect();
+setInterval(tickTimer, 250);
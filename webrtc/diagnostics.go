@@ -0,0 +1,55 @@
+package webrtc_session
+
+import (
+	"github.com/pion/webrtc/v4"
+)
+
+type Candidate struct {
+	Type     string `json:"type"` // host, srflx, prflx or relay
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     uint16 `json:"port"`
+}
+
+// ICEDiagnostics describe how a peer is connected
+type ICEDiagnostics struct {
+	ConnectionState string `json:"connectionState"`
+	ICEState        string `json:"iceState"`
+	// The candidate pair in use, nil until ICE picks one
+	Local  *Candidate `json:"local"`
+	Remote *Candidate `json:"remote"`
+	// Traffic goes through a TURN server
+	Relayed bool `json:"relayed"`
+}
+
+func candidate(c *webrtc.ICECandidate) *Candidate {
+	if c == nil {
+		return nil
+	}
+	return &Candidate{
+		Type:     c.Typ.String(),
+		Protocol: c.Protocol.String(),
+		Address:  c.Address,
+		Port:     c.Port,
+	}
+}
+
+func (ps *PeerSession) Diagnostics() ICEDiagnostics {
+	d := ICEDiagnostics{
+		ConnectionState: ps.Peer.ConnectionState().String(),
+		ICEState:        ps.Peer.ICEConnectionState().String(),
+	}
+
+	sctp := ps.Peer.SCTP()
+	if sctp == nil || sctp.Transport() == nil {
+		return d
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return d
+	}
+	d.Local = candidate(pair.Local)
+	d.Remote = candidate(pair.Remote)
+	d.Relayed = (d.Local != nil && d.Local.Type == "relay") || (d.Remote != nil && d.Remote.Type == "relay")
+	return d
+}
@@ -2,11 +2,13 @@ package webrtc_session
 
 import (
 	"encoding/json"
-	"log"
+	"polyserver/logging"
 
 	"github.com/pion/webrtc/v4"
 )
 
+var logger = logging.For("webrtc")
+
 type PeerSession struct {
 	SessionID    string
 	Peer         *webrtc.PeerConnection
@@ -16,21 +18,13 @@ type PeerSession struct {
 }
 
 func NewPeerSession(
+	peers *Peers,
 	sessionID string,
 	offerSDP string,
 	onIceCanFunc func(candidate []byte, session string) error,
-	IceUrls []string,
 	onClose func(string),
 ) (*PeerSession, string, error) {
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: IceUrls,
-			},
-		},
-	}
-
-	peer, err := webrtc.NewPeerConnection(config)
+	peer, err := peers.newPeerConnection()
 	if err != nil {
 		return nil, "", err
 	}
@@ -42,15 +36,12 @@ func NewPeerSession(
 	}
 
 	ps.Peer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		log.Println("Peer state:", state.String())
-	})
-
-	ps.Peer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		logger.Info("Peer state", "session", ps.SessionID, "state", state.String())
 		if state == webrtc.PeerConnectionStateFailed ||
 			state == webrtc.PeerConnectionStateDisconnected ||
 			state == webrtc.PeerConnectionStateClosed {
 
-			println("Cleaning up session:", ps.SessionID)
+			logger.Info("Cleaning up session", "session", ps.SessionID)
 			ps.Peer.Close()
 			onClose(ps.SessionID)
 		}
@@ -87,7 +78,7 @@ func (ps *PeerSession) handleOffer(offerSDP string) (string, error) {
 		return "", err
 	}
 
-	log.Println("Creating data channels...")
+	logger.Debug("Creating data channels", "session", ps.SessionID)
 	if err := ps.createDataChannels(); err != nil {
 		return "", err
 	}
@@ -0,0 +1,63 @@
+package webrtc_session
+
+import (
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Settings apply to every peer connection
+type Settings struct {
+	ICEServers []webrtc.ICEServer
+	// ICETransportPolicyRelay only uses TURN relays
+	TransportPolicy webrtc.ICETransportPolicy
+	// UDP ports to gather candidates on, 0 lets the OS pick
+	PortMin uint16
+	PortMax uint16
+	// Public IPs announced instead of the host's own addresses, for servers
+	// behind a 1:1 NAT
+	NAT1To1IPs           []string
+	NAT1To1CandidateType webrtc.ICECandidateType
+}
+
+// Peers creates peer connections sharing the same settings
+type Peers struct {
+	api    *webrtc.API
+	config webrtc.Configuration
+}
+
+func NewPeers(settings Settings) (*Peers, error) {
+	var engine webrtc.SettingEngine
+	if settings.PortMin != 0 || settings.PortMax != 0 {
+		if err := engine.SetEphemeralUDPPortRange(settings.PortMin, settings.PortMax); err != nil {
+			return nil, fmt.Errorf("invalid port range: %w", err)
+		}
+	}
+	if len(settings.NAT1To1IPs) > 0 {
+		candidateType := settings.NAT1To1CandidateType
+		if candidateType == webrtc.ICECandidateTypeUnknown {
+			candidateType = webrtc.ICECandidateTypeHost
+		}
+		err := engine.SetICEAddressRewriteRules(webrtc.ICEAddressRewriteRule{
+			External:        settings.NAT1To1IPs,
+			AsCandidateType: candidateType,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid NAT 1:1 settings: %w", err)
+		}
+	}
+
+	// Without ICE servers only host candidates are gathered, which is
+	// enough on a LAN
+	return &Peers{
+		api: webrtc.NewAPI(webrtc.WithSettingEngine(engine)),
+		config: webrtc.Configuration{
+			ICEServers:         settings.ICEServers,
+			ICETransportPolicy: settings.TransportPolicy,
+		},
+	}, nil
+}
+
+func (p *Peers) newPeerConnection() (*webrtc.PeerConnection, error) {
+	return p.api.NewPeerConnection(p.config)
+}
@@ -0,0 +1,42 @@
+package webrtc_session
+
+import (
+	"github.com/pion/webrtc/v4"
+)
+
+// ChannelStats are the traffic counters of a data channel
+type ChannelStats struct {
+	Label string `json:"label"`
+	State string `json:"state"`
+	// Bytes queued for sending that haven't gone out yet
+	BufferedAmount   uint64 `json:"bufferedAmount"`
+	MessagesSent     uint32 `json:"messagesSent"`
+	BytesSent        uint64 `json:"bytesSent"`
+	MessagesReceived uint32 `json:"messagesReceived"`
+	BytesReceived    uint64 `json:"bytesReceived"`
+}
+
+// ChannelStats reads the counters of the reliable and unreliable channels
+// from pion's stats report
+func (ps *PeerSession) ChannelStats() []ChannelStats {
+	report := ps.Peer.GetStats()
+	stats := make([]ChannelStats, 0, 2)
+	for _, dc := range []*webrtc.DataChannel{ps.ReliableDC, ps.UnreliableDC} {
+		if dc == nil {
+			continue
+		}
+		s := ChannelStats{
+			Label:          dc.Label(),
+			State:          dc.ReadyState().String(),
+			BufferedAmount: dc.BufferedAmount(),
+		}
+		if dcStats, ok := report.GetDataChannelStats(dc); ok {
+			s.MessagesSent = dcStats.MessagesSent
+			s.BytesSent = dcStats.BytesSent
+			s.MessagesReceived = dcStats.MessagesReceived
+			s.BytesReceived = dcStats.BytesReceived
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}